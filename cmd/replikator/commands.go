@@ -0,0 +1,9 @@
+package main
+
+// commands are subcommands of replikator, invoked as 'replikator COMMAND [flags]'
+var commands = map[string]func(args []string) error{
+	"diff":              runDiff,
+	"schema":            runSchema,
+	"test-modification": runTestModification,
+	"validate":          runValidate,
+}
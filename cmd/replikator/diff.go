@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/yankeguo/replikator"
+	"github.com/yankeguo/rg"
+)
+
+// printReplicaDiff prints the planned change of a replica
+func printReplicaDiff(w io.Writer, item replikator.ReplicaDiff) {
+	prefix := fmt.Sprintf("# task %s: %s/%s", item.Task, item.Namespace, item.Name)
+	switch {
+	case item.Error != nil:
+		fmt.Fprintf(w, "%s error: %s\n", prefix, item.Error.Error())
+	case item.Skipped:
+		fmt.Fprintf(w, "%s skipped, resource exists and not owned by replikator\n", prefix)
+	case item.Created:
+		fmt.Fprintf(w, "%s would create\n%s", prefix, item.Diff)
+	case item.Diff == "":
+		fmt.Fprintf(w, "%s unchanged\n", prefix)
+	default:
+		fmt.Fprintf(w, "%s would update\n%s", prefix, item.Diff)
+	}
+}
+
+// runDiff prints differences between live replicas and replicas computed from task definitions
+func runDiff(args []string) (err error) {
+	defer rg.Guard(&err)
+
+	flags := rg.Must(replikator.ParseDiffFlags(args))
+
+	client, dynClient := rg.Must2(flags.CreateKubernetesClient())
+
+	ctx := context.Background()
+
+	defs := rg.Must(replikator.LoadTaskDefinitionsFromDir(flags.Conf))
+	if flags.CRD {
+		defs = append(defs, rg.Must(replikator.LoadTaskDefinitionsFromCluster(ctx, dynClient, flags.CRDResources))...)
+	}
+	tasks := rg.Must(defs.Build())
+
+	var failed int
+
+	for _, task := range tasks {
+		session := task.NewSession(replikator.TaskOptions{
+			Client:        client,
+			DynamicClient: dynClient,
+			DryRun:        true,
+		})
+
+		diffs, err := session.Diff(ctx)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "# task %s error: %s\n", task.ID(), err.Error())
+			continue
+		}
+
+		for _, item := range diffs {
+			if item.Error != nil {
+				failed++
+			}
+			printReplicaDiff(os.Stdout, item)
+		}
+	}
+
+	if failed > 0 {
+		err = fmt.Errorf("%d errors occurred", failed)
+	}
+
+	return
+}
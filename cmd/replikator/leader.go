@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yankeguo/replikator"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// runWithLeaderElection runs fn only while holding the lease, returns error once leadership is lost
+func runWithLeaderElection(mainCtx context.Context, client kubernetes.Interface, opts replikator.LeaderElectionFlags, probe *probeState, fn func(ctx context.Context) error) (err error) {
+	identity, _ := os.Hostname()
+
+	log := log.WithField("lease", opts.Namespace+"/"+opts.LeaseName).WithField("identity", identity)
+
+	var (
+		leading = make(chan struct{})
+		done    = make(chan struct{})
+		fnErr   error
+	)
+
+	ctx, cancel := context.WithCancel(mainCtx)
+	defer cancel()
+
+	probe.setStandby(true)
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metaV1.ObjectMeta{Namespace: opts.Namespace, Name: opts.LeaseName},
+			Client:    client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: identity,
+			},
+		},
+		LeaseDuration:   opts.LeaseDuration,
+		RenewDeadline:   opts.RenewDeadline,
+		RetryPeriod:     opts.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				defer close(done)
+				close(leading)
+				log.Info("leadership acquired")
+				probe.setStandby(false)
+				fnErr = fn(ctx)
+				// release the lease if fn exits early
+				cancel()
+			},
+			OnStoppedLeading: func() {
+				log.Info("leadership released")
+			},
+			OnNewLeader: func(id string) {
+				if id != identity {
+					log.WithField("leader", id).Info("new leader elected")
+				}
+			},
+		},
+	})
+
+	select {
+	case <-leading:
+	default:
+		// leadership never acquired
+		return
+	}
+
+	// wait for fn to exit, context is cancelled once leadership is lost
+	<-done
+
+	if fnErr != nil {
+		err = fnErr
+		return
+	}
+
+	if mainCtx.Err() == nil {
+		err = errors.New("leadership lost")
+	}
+
+	return
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/yankeguo/replikator"
 	"github.com/yankeguo/rg"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
@@ -35,6 +41,7 @@ func createReloadChanel(mainCtx context.Context, dir string) chan struct{} {
 			if newDigest, _ := replikator.DigestTaskDefinitionsFromDir(dir); newDigest != digest {
 				digest = newDigest
 				log.WithField("digest", digest).Info("task definitions changed")
+				replikator.MetricConfigReloads.Inc()
 				select {
 				case <-mainCtx.Done():
 				case reload <- struct{}{}:
@@ -78,7 +85,88 @@ func createReloadContextChannel(mainCtx context.Context, dir string) chan contex
 	return chCtx
 }
 
+// probeState tracks sessions of current task definitions, for health and readiness probes
+type probeState struct {
+	lock       sync.Mutex
+	controller *replikator.Controller
+	loaded     bool
+	standby    bool
+}
+
+// setStandby marks the process waiting for leadership, which is always ready
+func (p *probeState) setStandby(standby bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.standby = standby
+}
+
+func (p *probeState) set(controller *replikator.Controller, loaded bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.controller = controller
+	p.loaded = loaded
+}
+
+func (p *probeState) check(ready bool) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var sessions replikator.SessionList
+	if p.controller != nil {
+		sessions = p.controller.Sessions()
+	}
+	if ready {
+		if p.standby {
+			return nil
+		}
+		if !p.loaded {
+			return errors.New("task definitions not loaded")
+		}
+		return sessions.Ready()
+	}
+	return sessions.Healthy()
+}
+
+func (p *probeState) handler(ready bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if err := p.check(ready); err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte("ok"))
+	}
+}
+
+func runHTTPServer(ctx context.Context, addr string, probe *probeState) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", probe.handler(false))
+	mux.Handle("/readyz", probe.handler(true))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.WithField("addr", addr).Info("http server starting")
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("http server failed")
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var err error
 	defer func() {
 		if err == nil {
@@ -100,7 +188,7 @@ func main() {
 
 	log.WithField("version", AppVersion).Info("replikator starting")
 
-	flags := rg.Must(replikator.ParseFlags())
+	flags := rg.Must(replikator.ParseFlags(os.Args[1:]))
 
 	client, dynClient := rg.Must2(flags.CreateKubernetesClient())
 
@@ -115,23 +203,82 @@ func main() {
 		cancelMainCtx()
 	}()
 
+	probe := &probeState{}
+
+	if flags.Listen != "" {
+		go runHTTPServer(mainCtx, flags.Listen, probe)
+	}
+
+	recorder, shutdownRecorder := replikator.NewEventRecorder(client)
+	defer shutdownRecorder()
+
+	reconciler := replikator.NewReconciler(replikator.ReconcilerOptions{
+		Client:        client,
+		DynamicClient: dynClient,
+		GracePeriod:   flags.Prune.GracePeriod,
+		DryRun:        flags.Prune.DryRun || flags.DryRun,
+		EventRecorder: recorder,
+	})
+
 	routine := func(ctx context.Context) (err error) {
 		defer rg.Guard(&err)
-		defs := rg.Must(replikator.LoadTaskDefinitionsFromDir(flags.Conf))
-		tasks := rg.Must(defs.Build())
+		tasks := rg.Must(rg.Must(replikator.LoadTaskDefinitionsFromDir(flags.Conf)).Build())
 		log.WithField("count", len(tasks)).Info("tasks loaded")
-		tasks.NewSessions(replikator.TaskOptions{
-			Client:        client,
-			DynamicClient: dynClient,
-		}).Run(ctx)
+
+		taskOpts := replikator.TaskOptions{
+			Client:          client,
+			DynamicClient:   dynClient,
+			StatusConfigMap: flags.StatusConfigMap,
+			EventRecorder:   recorder,
+			DryRun:          flags.DryRun,
+			ResyncPeriod:    flags.Resync.Period,
+			Reconciler:      reconciler,
+		}
+
+		controller := replikator.NewController(replikator.RunOptions{
+			Client:         client,
+			DynamicClient:  dynClient,
+			ResyncJitter:   flags.Resync.Jitter,
+			RetryBaseDelay: flags.Retry.BaseDelay,
+			RetryMaxDelay:  flags.Retry.MaxDelay,
+		})
+		for _, session := range tasks.NewSessions(taskOpts) {
+			rg.Must0(controller.Add(session))
+		}
+
+		var synced []cache.InformerSynced
+		if flags.CRD {
+			synced = append(synced, replikator.WatchReplications(ctx, controller, taskOpts, flags.CRDResources))
+		}
+
+		go func() {
+			// replicas of Replications not loaded yet are not orphaned
+			if cache.WaitForCacheSync(ctx.Done(), synced...) {
+				reconciler.Run(ctx, controller.Tasks)
+			}
+		}()
+
+		probe.set(controller, true)
+		defer probe.set(nil, false)
+		controller.Run(ctx)
 		return
 	}
 
-	chCtx := createReloadContextChannel(mainCtx, flags.Conf)
+	run := func(ctx context.Context) (err error) {
+		// Replication custom resources are watched, they do not reload configuration files
+		chCtx := createReloadContextChannel(ctx, flags.Conf)
 
-	for ctx := range chCtx {
-		if err = routine(ctx); err != nil {
-			return
+		for ctx := range chCtx {
+			if err = routine(ctx); err != nil {
+				return
+			}
 		}
+		return
+	}
+
+	if flags.LeaderElection.Enabled {
+		err = runWithLeaderElection(mainCtx, client, flags.LeaderElection, probe, run)
+	} else {
+		err = run(mainCtx)
 	}
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+
+	"github.com/yankeguo/replikator"
+	"github.com/yankeguo/rg"
+)
+
+// runSchema prints JSON Schema of task definition files
+func runSchema(args []string) (err error) {
+	defer rg.Guard(&err)
+
+	rg.Must(os.Stdout.Write(rg.Must(replikator.TaskDefinitionSchemaJSON())))
+
+	return
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/yankeguo/replikator"
+	"github.com/yankeguo/rg"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// runTestModification runs modifications of a task on a local resource file, and prints the result
+func runTestModification(args []string) (err error) {
+	defer rg.Guard(&err)
+
+	flags := rg.Must(replikator.ParseTestModificationFlags(args))
+
+	tasks := rg.Must(rg.Must(replikator.LoadTaskDefinitionsFromFile(flags.Task)).Build())
+
+	var task *replikator.Task
+	for _, item := range tasks {
+		if flags.ID == "" || item.ID() == flags.ID {
+			if task != nil {
+				return errors.New("multiple tasks in " + flags.Task + ", select one with --id")
+			}
+			task = item
+		}
+	}
+	if task == nil {
+		return errors.New("no task found in " + flags.Task)
+	}
+
+	input := &unstructured.Unstructured{}
+	rg.Must0(yaml.Unmarshal(rg.Must(os.ReadFile(flags.Input)), &input.Object))
+
+	namespace := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: flags.Namespace}}
+	if flags.NamespaceFile != "" {
+		rg.Must0(yaml.Unmarshal(rg.Must(os.ReadFile(flags.NamespaceFile)), namespace))
+		if namespace.Name == "" {
+			return errors.New("metadata.name is required in " + flags.NamespaceFile)
+		}
+	}
+
+	out := rg.Must(task.Modify(input, namespace))
+
+	fmt.Print(string(rg.Must(yaml.Marshal(out.Object))))
+
+	return
+}
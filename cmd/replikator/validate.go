@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/yankeguo/replikator"
+	"github.com/yankeguo/rg"
+)
+
+// runValidate validates task definitions in the configuration directory and files, and prints errors
+func runValidate(args []string) (err error) {
+	defer rg.Guard(&err)
+
+	flags := rg.Must(replikator.ParseValidateFlags(args))
+
+	var errs []replikator.ValidationError
+
+	if flags.Conf != "" {
+		errs = append(errs, rg.Must(replikator.ValidateTaskDefinitionsFromDir(flags.Conf))...)
+	}
+	for _, file := range flags.Files {
+		errs = append(errs, rg.Must(replikator.ValidateTaskDefinitionsFromFile(file))...)
+	}
+
+	for _, item := range errs {
+		fmt.Fprintln(os.Stdout, item.Error())
+	}
+
+	if len(errs) > 0 {
+		err = fmt.Errorf("%d errors found", len(errs))
+	}
+
+	return
+}
@@ -0,0 +1,558 @@
+package replikator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	informerCoreV1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// controllerWorkers is the number of concurrent synchronizations, synchronizations of a session are serialized
+const controllerWorkers = 4
+
+const (
+	// DefaultResyncPeriod is the default period of full synchronizations
+	DefaultResyncPeriod = 10 * time.Minute
+	// DefaultResyncJitter is the default jitter factor of full synchronizations
+	DefaultResyncJitter = 0.1
+	// DefaultRetryBaseDelay and DefaultRetryMaxDelay are the default exponential backoff of failed synchronizations and namespaces
+	DefaultRetryBaseDelay = time.Second
+	DefaultRetryMaxDelay  = 5 * time.Minute
+)
+
+// RunOptions is the options for running sessions
+type RunOptions struct {
+	// Client and DynamicClient are used by shared informers, default to clients of the first session in SessionList.Run
+	Client        kubernetes.Interface
+	DynamicClient dynamic.Interface
+	// ResyncJitter is the jitter factor of full synchronizations, each period is extended randomly up to the factor, 0 to disable
+	ResyncJitter float64
+	// RetryBaseDelay and RetryMaxDelay are the exponential backoff of failed synchronizations and namespaces,
+	// default to DefaultRetryBaseDelay and DefaultRetryMaxDelay
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+// queueKey is the key of the work queue, synchronizes the session in the namespace, or all namespaces if empty
+type queueKey struct {
+	session   *Session
+	namespace string
+}
+
+// sourceKey is the key of source informers, sources are watched once per resource and source namespace
+type sourceKey struct {
+	resource  schema.GroupVersionResource
+	namespace string
+}
+
+// sharedInformer is an informer shared by sessions, started with the first session, and stopped with the last one
+type sharedInformer struct {
+	informer cache.SharedIndexInformer
+	lister   cache.GenericLister
+	health   *watchHealth
+	sessions SessionList
+	stop     context.CancelFunc
+}
+
+// Controller runs sessions on shared informers, namespaces are watched once, sources are watched once per resource and
+// source namespace, replicas are watched once per resource in all namespaces, filtered by LabelManaged,
+// synchronizations are queued by session and namespace, and retried with exponential backoff,
+// sessions can be added and removed while running, without affecting other sessions
+type Controller struct {
+	opts  RunOptions
+	log   *logrus.Entry
+	queue workqueue.TypedRateLimitingInterface[queueKey]
+
+	namespaceFactory  informers.SharedInformerFactory
+	namespaceInformer informerCoreV1.NamespaceInformer
+	namespaceHealth   *watchHealth
+
+	lock     sync.Mutex
+	ctx      context.Context
+	sessions SessionList
+	cancels  map[*Session]context.CancelFunc
+	sources  map[sourceKey]*sharedInformer
+	replicas map[schema.GroupVersionResource]*sharedInformer
+}
+
+// NewController creates a new Controller, sessions are added by Add, and run by Run
+func NewController(opts RunOptions) *Controller {
+	if opts.RetryBaseDelay <= 0 {
+		opts.RetryBaseDelay = DefaultRetryBaseDelay
+	}
+	if opts.RetryMaxDelay <= 0 {
+		opts.RetryMaxDelay = DefaultRetryMaxDelay
+	}
+
+	c := &Controller{
+		opts: opts,
+		log:  logrus.WithField("component", "controller"),
+		queue: workqueue.NewTypedRateLimitingQueue(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[queueKey](opts.RetryBaseDelay, opts.RetryMaxDelay),
+		),
+		namespaceFactory: informers.NewSharedInformerFactory(opts.Client, 0),
+		namespaceHealth:  &watchHealth{name: "namespaces"},
+		cancels:          map[*Session]context.CancelFunc{},
+		sources:          map[sourceKey]*sharedInformer{},
+		replicas:         map[schema.GroupVersionResource]*sharedInformer{},
+	}
+
+	// namespaces are watched for all sessions
+	c.namespaceInformer = c.namespaceFactory.Core().V1().Namespaces()
+	c.watchInformer(c.namespaceInformer.Informer(), c.namespaceHealth, c.Sessions, cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			// existing namespaces are covered by the initial full synchronization
+			if ns, ok := obj.(*coreV1.Namespace); ok && !isInInitialList {
+				c.onNamespace(nil, ns)
+			}
+		},
+		UpdateFunc: func(oldObj, obj any) {
+			old, _ := oldObj.(*coreV1.Namespace)
+			if ns, ok := obj.(*coreV1.Namespace); ok && old != nil {
+				c.onNamespace(old, ns)
+			}
+		},
+	})
+
+	return c
+}
+
+// Sessions returns sessions currently running
+func (c *Controller) Sessions() SessionList {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append(SessionList(nil), c.sessions...)
+}
+
+// Tasks returns tasks of sessions currently running
+func (c *Controller) Tasks() (tasks TaskList) {
+	for _, session := range c.Sessions() {
+		tasks = append(tasks, session.task)
+	}
+	return
+}
+
+// sessionsOf returns sessions currently using the shared informer
+func (c *Controller) sessionsOf(si *sharedInformer) SessionList {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append(SessionList(nil), si.sessions...)
+}
+
+// active checks whether the session is not removed
+func (c *Controller) active(session *Session) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.cancels[session]
+	return ok
+}
+
+// startInformer starts the shared informer, if the controller is running
+func (c *Controller) startInformer(si *sharedInformer) {
+	if c.ctx == nil || si.stop != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, si.stop = context.WithCancel(c.ctx)
+	go si.informer.Run(ctx.Done())
+}
+
+// startSession starts periodic synchronizations of the session, if the controller is running
+func (c *Controller) startSession(session *Session, synced ...cache.InformerSynced) {
+	if c.ctx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.cancels[session] = cancel
+	go c.resync(ctx, session, synced...)
+}
+
+// Add adds a session to the controller, sessions of the same task id are not allowed
+func (c *Controller) Add(session *Session) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, item := range c.sessions {
+		if item.task.id == session.task.id {
+			err = fmt.Errorf("duplicate task id: %s", session.task.id)
+			return
+		}
+	}
+
+	// sources
+	srcKey := sourceKey{resource: session.task.resource, namespace: session.task.srcNamespace}
+	src := c.sources[srcKey]
+	if src == nil {
+		informer := dynamicinformer.NewFilteredDynamicInformer(c.opts.DynamicClient, srcKey.resource, srcKey.namespace, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}, nil)
+		src = &sharedInformer{
+			informer: informer.Informer(),
+			lister:   informer.Lister(),
+			health:   &watchHealth{name: srcKey.resource.String() + " in " + srcKey.namespace},
+		}
+		c.watchInformer(src.informer, src.health, func() SessionList { return c.sessionsOf(src) }, cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj any, isInInitialList bool) {
+				// existing sources are covered by the initial full synchronization
+				if !isInInitialList {
+					c.onSource(c.sessionsOf(src), nil, obj)
+				}
+			},
+			UpdateFunc: func(oldObj, obj any) {
+				c.onSource(c.sessionsOf(src), oldObj, obj)
+			},
+			DeleteFunc: func(obj any) {
+				c.onSource(c.sessionsOf(src), nil, obj)
+			},
+		})
+		c.sources[srcKey] = src
+	}
+	src.sessions = append(src.sessions, session)
+
+	// replicas
+	replica := c.replicas[session.task.resource]
+	if replica == nil {
+		informer := dynamicinformer.NewFilteredDynamicInformer(c.opts.DynamicClient, session.task.resource, metaV1.NamespaceAll, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}, func(opts *metaV1.ListOptions) {
+			opts.LabelSelector = LabelManaged + "=true"
+		})
+		replica = &sharedInformer{
+			informer: informer.Informer(),
+			lister:   informer.Lister(),
+			health:   &watchHealth{name: "replicas of " + session.task.resource.String()},
+		}
+		c.watchInformer(replica.informer, replica.health, func() SessionList { return c.sessionsOf(replica) }, cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj any, isInInitialList bool) {},
+			UpdateFunc: func(oldObj, obj any) {
+				c.onReplica(c.sessionsOf(replica), watch.Modified, obj)
+			},
+			DeleteFunc: func(obj any) {
+				c.onReplica(c.sessionsOf(replica), watch.Deleted, obj)
+			},
+		})
+		c.replicas[session.task.resource] = replica
+	}
+	replica.sessions = append(replica.sessions, session)
+
+	session.namespaceLister = c.namespaceInformer.Lister()
+	session.sourceLister = src.lister
+	session.health.setWatches(c.namespaceHealth, src.health, replica.health)
+
+	c.sessions = append(c.sessions, session)
+	c.cancels[session] = nil
+	metricActiveSessions.Inc()
+
+	c.startInformer(src)
+	c.startInformer(replica)
+	c.startSession(session, c.namespaceInformer.Informer().HasSynced, src.informer.HasSynced, replica.informer.HasSynced)
+
+	session.log.Info("session added")
+
+	return
+}
+
+// removeSession removes the session from the list
+func removeSession(list SessionList, session *Session) (out SessionList) {
+	for _, item := range list {
+		if item != session {
+			out = append(out, item)
+		}
+	}
+	return
+}
+
+// Remove removes a session from the controller, informers no longer used are stopped
+func (c *Controller) Remove(session *Session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cancel, ok := c.cancels[session]
+	if !ok {
+		return
+	}
+	if cancel != nil {
+		cancel()
+	}
+	delete(c.cancels, session)
+
+	c.sessions = removeSession(c.sessions, session)
+	metricActiveSessions.Dec()
+
+	srcKey := sourceKey{resource: session.task.resource, namespace: session.task.srcNamespace}
+	if src := c.sources[srcKey]; src != nil {
+		if src.sessions = removeSession(src.sessions, session); len(src.sessions) == 0 {
+			if src.stop != nil {
+				src.stop()
+			}
+			delete(c.sources, srcKey)
+		}
+	}
+	if replica := c.replicas[session.task.resource]; replica != nil {
+		if replica.sessions = removeSession(replica.sessions, session); len(replica.sessions) == 0 {
+			if replica.stop != nil {
+				replica.stop()
+			}
+			delete(c.replicas, session.task.resource)
+		}
+	}
+
+	session.log.Info("session removed")
+}
+
+// isWatchExpired checks whether the watch stopped for an expired resource version, e.g. compacted by etcd,
+// informers list again and resume from the new resource version, it's not a failure
+func isWatchExpired(err error) bool {
+	return errors.IsResourceExpired(err) || errors.IsGone(err)
+}
+
+// watchInformer registers the event handler and the watch error handler of the shared informer, used by sessions,
+// informers list then watch from the listed resource version, with bookmarks to keep the resource version recent
+func (c *Controller) watchInformer(informer cache.SharedIndexInformer, health *watchHealth, sessions func() SessionList, handler cache.ResourceEventHandlerDetailedFuncs) {
+	_ = informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		// watch closed normally
+		if err == io.EOF {
+			return
+		}
+		if isWatchExpired(err) {
+			c.log.WithField("watch", health.name).WithError(err).Debug("watch expired, listing again")
+			return
+		}
+		health.failed(time.Now())
+		for _, session := range sessions() {
+			metricWatchRestarts.WithLabelValues(session.task.id).Inc()
+		}
+		c.log.WithField("watch", health.name).WithError(err).Error("watch error")
+	})
+
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			health.recovered()
+			handler.AddFunc(obj, isInInitialList)
+		},
+		UpdateFunc: func(oldObj, obj any) {
+			health.recovered()
+			handler.UpdateFunc(oldObj, obj)
+		},
+		DeleteFunc: func(obj any) {
+			health.recovered()
+			if handler.DeleteFunc != nil {
+				handler.DeleteFunc(obj)
+			}
+		},
+	})
+}
+
+func (c *Controller) enqueue(session *Session, namespace string) {
+	c.queue.Add(queueKey{session: session, namespace: namespace})
+}
+
+// onNamespace queues synchronizations of sessions for a namespace added or updated, old is nil if added
+func (c *Controller) onNamespace(old *coreV1.Namespace, ns *coreV1.Namespace) {
+	// only labels and annotations are relevant to tasks
+	if old != nil && reflect.DeepEqual(old.Labels, ns.Labels) && reflect.DeepEqual(old.Annotations, ns.Annotations) {
+		return
+	}
+	for _, session := range c.Sessions() {
+		// namespace may stop matching, synchronize for pruning
+		if session.task.matchNamespace(ns) || (old != nil && session.task.prune && session.task.matchNamespace(old)) {
+			c.enqueue(session, ns.Name)
+		}
+	}
+}
+
+// onSource queues full synchronizations of sessions for a source changed, old is nil if added or deleted
+func (c *Controller) onSource(sessions SessionList, oldObj any, obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	item, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	var old metaV1.Object
+	if oldObj != nil {
+		old, _ = meta.Accessor(oldObj)
+	}
+
+	for _, session := range sessions {
+		// objects stop matching the selector are sources too
+		if session.task.isSource(item) || (old != nil && session.task.isSource(old)) {
+			session.retries.reset()
+			c.enqueue(session, "")
+		}
+	}
+}
+
+// onReplica queues synchronizations of the namespace, for replicas modified or deleted by others
+func (c *Controller) onReplica(sessions SessionList, eventType watch.EventType, obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	item, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	for _, session := range sessions {
+		if item.GetLabels()[LabelTask] != session.task.id {
+			continue
+		}
+
+		key := item.GetNamespace() + "/" + item.GetName()
+		if session.replicas.observe(key, item.GetResourceVersion(), eventType == watch.Deleted) {
+			session.log.WithField("dst", key).WithField("event", eventType).Info("replica drifted")
+			c.enqueue(session, item.GetNamespace())
+		}
+	}
+}
+
+// process processes a key from the queue, returns false if the queue is shut down
+func (c *Controller) process(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	// session removed
+	if !c.active(key.session) {
+		c.queue.Forget(key)
+		return true
+	}
+
+	retries, err := key.session.sync(ctx, key.namespace)
+	if err != nil && ctx.Err() == nil {
+		c.queue.AddRateLimited(key)
+	} else {
+		c.queue.Forget(key)
+	}
+
+	// namespaces failed are retried separately, with backoff by consecutive failures
+	for namespace, attempts := range retries {
+		delay := retryBackoff(attempts, c.opts.RetryBaseDelay, c.opts.RetryMaxDelay)
+		key.session.log.WithField("ns", namespace).WithField("attempts", attempts).WithField("delay", delay).Info("retrying")
+		c.queue.AddAfter(queueKey{session: key.session, namespace: namespace}, delay)
+	}
+	return true
+}
+
+// Run runs the controller until context is done, sessions added are started immediately
+func (c *Controller) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	c.namespaceFactory.Start(ctx.Done())
+	defer c.namespaceFactory.Shutdown()
+
+	c.lock.Lock()
+	c.ctx = ctx
+	for _, si := range c.sources {
+		c.startInformer(si)
+	}
+	for _, si := range c.replicas {
+		c.startInformer(si)
+	}
+	for _, session := range c.sessions {
+		c.startSession(session,
+			c.namespaceInformer.Informer().HasSynced,
+			c.sources[sourceKey{resource: session.task.resource, namespace: session.task.srcNamespace}].informer.HasSynced,
+			c.replicas[session.task.resource].informer.HasSynced,
+		)
+	}
+	c.lock.Unlock()
+
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < controllerWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.process(ctx) {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	c.queue.ShutDown()
+	wg.Wait()
+
+	// informers and synchronizations are stopped with context
+	for _, session := range c.Sessions() {
+		c.Remove(session)
+	}
+}
+
+// resyncDelay returns the period extended randomly up to the jitter factor, wait.Jitter treats factors not positive as 1.0
+func resyncDelay(period time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return period
+	}
+	return wait.Jitter(period, jitter)
+}
+
+// resync queues full synchronizations of the session, initially and periodically with jitter, until context is done,
+// the initial synchronization waits for informers used by the session
+func (c *Controller) resync(ctx context.Context, session *Session, synced ...cache.InformerSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return
+	}
+
+	for {
+		session.retries.reset()
+		c.enqueue(session, "")
+
+		if session.resyncPeriod <= 0 {
+			return
+		}
+
+		timer := time.NewTimer(resyncDelay(session.resyncPeriod, c.opts.ResyncJitter))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Run all sessions until context is done, on shared informers and a work queue
+func (list SessionList) Run(ctx context.Context, opts RunOptions) {
+	if len(list) == 0 || ctx.Err() != nil {
+		return
+	}
+	if opts.Client == nil {
+		opts.Client = list[0].client
+	}
+	if opts.DynamicClient == nil {
+		opts.DynamicClient = list[0].dynClient
+	}
+	c := NewController(opts)
+	for _, session := range list {
+		if err := c.Add(session); err != nil {
+			session.log.WithError(err).Error("session not added")
+		}
+	}
+	c.Run(ctx)
+}
@@ -0,0 +1,186 @@
+package replikator
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testController(t *testing.T, defs ...TaskDefinition) *Controller {
+	tasks, err := TaskDefinitionList(defs).Build()
+	require.NoError(t, err)
+
+	c := NewController(RunOptions{})
+	for _, session := range tasks.NewSessions(TaskOptions{}) {
+		require.NoError(t, c.Add(session))
+	}
+	t.Cleanup(c.queue.ShutDown)
+	return c
+}
+
+// drainQueue returns namespaces of queued keys, keyed by task id
+func drainQueue(c *Controller) map[string][]string {
+	out := map[string][]string{}
+	for c.queue.Len() > 0 {
+		key, _ := c.queue.Get()
+		out[key.session.task.id] = append(out[key.session.task.id], key.namespace)
+		c.queue.Done(key)
+		c.queue.Forget(key)
+	}
+	return out
+}
+
+func testControllerDefinition(id string, prune bool) TaskDefinition {
+	var def TaskDefinition
+	def.ID = id
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = "^team-"
+	def.Prune = prune
+	return def
+}
+
+func TestControllerOnNamespace(t *testing.T) {
+	c := testController(t, testControllerDefinition("task-a", false), testControllerDefinition("task-b", true))
+
+	// added
+	c.onNamespace(nil, &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "team-a"}})
+	c.onNamespace(nil, &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "other"}})
+	require.Equal(t, map[string][]string{"task-a": {"team-a"}, "task-b": {"team-a"}}, drainQueue(c))
+
+	// labels and annotations not changed
+	old := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "team-a"}}
+	ns := old.DeepCopy()
+	ns.Status.Phase = coreV1.NamespaceTerminating
+	c.onNamespace(old, ns)
+	require.Empty(t, drainQueue(c))
+
+	// opted-out, only task with prune
+	ns.Annotations = map[string]string{AnnotationNamespaceSkip: "*"}
+	c.onNamespace(old, ns)
+	require.Equal(t, map[string][]string{"task-b": {"team-a"}}, drainQueue(c))
+}
+
+func TestControllerOnSourceAndReplica(t *testing.T) {
+	c := testController(t, testControllerDefinition("task-a", false))
+	session := c.Sessions()[0]
+
+	src := &unstructured.Unstructured{Object: map[string]any{}}
+	src.SetNamespace("default")
+	src.SetName("registry-credentials")
+
+	other := &unstructured.Unstructured{Object: map[string]any{}}
+	other.SetNamespace("default")
+	other.SetName("other")
+
+	// sources trigger full synchronizations, and start retries over
+	for i := 0; i <= RetryLimit; i++ {
+		session.retries.failed("team-a")
+	}
+	c.onSource(c.Sessions(), src, src)
+	require.Equal(t, 1, session.retries.failed("team-a"))
+	c.onSource(c.Sessions(), nil, other)
+	require.Equal(t, map[string][]string{"task-a": {""}}, drainQueue(c))
+
+	c.onSource(c.Sessions(), nil, cache.DeletedFinalStateUnknown{Key: "default/registry-credentials", Obj: src})
+	require.Equal(t, map[string][]string{"task-a": {""}}, drainQueue(c))
+
+	// replicas trigger synchronizations of the namespace if drifted
+	replica := &unstructured.Unstructured{Object: map[string]any{}}
+	replica.SetNamespace("team-a")
+	replica.SetName("registry-credentials")
+	replica.SetResourceVersion("2")
+	replica.SetLabels(map[string]string{LabelManaged: "true", LabelTask: "task-a"})
+
+	session.replicas.setApplied("team-a/registry-credentials", "2")
+	c.onReplica(c.Sessions(), watch.Modified, replica)
+	require.Empty(t, drainQueue(c))
+
+	replica.SetResourceVersion("3")
+	c.onReplica(c.Sessions(), watch.Modified, replica)
+	require.Equal(t, map[string][]string{"task-a": {"team-a"}}, drainQueue(c))
+
+	// replicas of other tasks
+	replica.SetLabels(map[string]string{LabelManaged: "true", LabelTask: "task-b"})
+	c.onReplica(c.Sessions(), watch.Deleted, replica)
+	require.Empty(t, drainQueue(c))
+}
+
+func TestControllerResync(t *testing.T) {
+	c := testController(t, testControllerDefinition("task-a", false))
+
+	// periodic synchronizations disabled, only initial synchronization
+	session := c.Sessions()[0]
+	c.resync(context.Background(), session)
+	require.Equal(t, map[string][]string{"task-a": {""}}, drainQueue(c))
+
+	// stopped with context
+	session.resyncPeriod = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.resync(ctx, session)
+	require.Equal(t, map[string][]string{"task-a": {""}}, drainQueue(c))
+}
+
+func TestControllerAddRemove(t *testing.T) {
+	c := testController(t, testControllerDefinition("task-a", false), testControllerDefinition("task-b", true))
+	sessions := c.Sessions()
+	require.Len(t, sessions, 2)
+	require.Len(t, c.sources, 1)
+	require.Len(t, c.replicas, 1)
+	require.Equal(t, sessions[0].sourceLister, sessions[1].sourceLister)
+
+	// duplicate task id
+	tasks, err := TaskDefinitionList{testControllerDefinition("task-a", true)}.Build()
+	require.NoError(t, err)
+	require.Error(t, c.Add(tasks[0].NewSession(TaskOptions{})))
+	require.Len(t, c.Sessions(), 2)
+
+	// informers are kept for other sessions
+	c.Remove(sessions[0])
+	require.Equal(t, SessionList{sessions[1]}, c.Sessions())
+	require.Len(t, c.sources, 1)
+	require.Len(t, c.replicas, 1)
+
+	// removed twice
+	c.Remove(sessions[0])
+	require.Len(t, c.Sessions(), 1)
+
+	// informers are dropped with the last session
+	c.Remove(sessions[1])
+	require.Empty(t, c.Sessions())
+	require.Empty(t, c.sources)
+	require.Empty(t, c.replicas)
+
+	// queued keys of removed sessions are skipped
+	c.enqueue(sessions[1], "")
+	require.True(t, c.process(context.Background()))
+	require.Zero(t, c.queue.Len())
+}
+
+func TestResyncDelay(t *testing.T) {
+	require.Equal(t, time.Minute, resyncDelay(time.Minute, 0))
+
+	for i := 0; i < 100; i++ {
+		delay := resyncDelay(time.Minute, 0.1)
+		require.GreaterOrEqual(t, delay, time.Minute)
+		require.LessOrEqual(t, delay, time.Minute+6*time.Second)
+	}
+}
+
+func TestIsWatchExpired(t *testing.T) {
+	require.True(t, isWatchExpired(errors.NewResourceExpired("too old resource version: 1 (2)")))
+	require.True(t, isWatchExpired(errors.NewGone("gone")))
+	require.False(t, isWatchExpired(errors.NewInternalError(io.ErrUnexpectedEOF)))
+	require.False(t, isWatchExpired(io.EOF))
+}
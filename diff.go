@@ -0,0 +1,117 @@
+package replikator
+
+import (
+	"context"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/yankeguo/rg"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// normalizeForDiff removes server populated metadata, which changes on every write
+func normalizeForDiff(obj *unstructured.Unstructured) map[string]any {
+	if obj == nil {
+		return nil
+	}
+	obj = obj.DeepCopy()
+	for _, field := range []string{"managedFields", "resourceVersion", "uid", "generation", "creationTimestamp"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	return obj.Object
+}
+
+// diffResources returns a unified diff of YAML between the live resource and the desired one, live can be nil
+func diffResources(live *unstructured.Unstructured, desired *unstructured.Unstructured) (diff string, err error) {
+	defer rg.Guard(&err)
+
+	var from string
+	if live != nil {
+		from = string(rg.Must(yaml.Marshal(normalizeForDiff(live))))
+	}
+	to := string(rg.Must(yaml.Marshal(normalizeForDiff(desired))))
+
+	diff = rg.Must(difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from),
+		B:        difflib.SplitLines(to),
+		FromFile: "live",
+		ToFile:   "replica",
+		Context:  3,
+	}))
+	return
+}
+
+// diffReplica returns a unified diff between the live replica and the desired one, created is true if the live one does not exist
+func (s *Session) diffReplica(ctx context.Context, replica *unstructured.Unstructured) (diff string, created bool, err error) {
+	live, err := s.dynClient.Resource(s.task.resource).Namespace(replica.GetNamespace()).Get(ctx, replica.GetName(), metaV1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return
+		}
+		live, created, err = nil, true, nil
+	}
+	diff, err = diffResources(live, replica)
+	return
+}
+
+// ReplicaDiff is the planned change of a replica
+type ReplicaDiff struct {
+	Task      string
+	Namespace string
+	Name      string
+	// Created is true if the replica does not exist yet
+	Created bool
+	// Skipped is true if the replica exists and can not be overwritten, according to the conflict policy
+	Skipped bool
+	// Diff is the unified YAML diff against the live replica, empty if unchanged
+	Diff string
+	// Error is the error computing the replica, if any
+	Error error
+}
+
+// Diff computes replicas of all sources in all matching namespaces with server-side dry-run, and compares them with live replicas
+func (s *Session) Diff(ctx context.Context) (diffs []ReplicaDiff, err error) {
+	defer rg.Guard(&err)
+
+	namespaces := rg.Must(s.listDestinationNamespaces(ctx))
+	sources := rg.Must(s.fetchResources(ctx))
+
+	for _, src := range sources {
+		for _, ns := range namespaces {
+			item := ReplicaDiff{Task: s.task.id, Namespace: ns.Name}
+
+			item.Name, item.Error = s.task.targetName(src, ns)
+			if item.Error == nil {
+				item.Created, item.Skipped, item.Diff, item.Error = s.diffTarget(ctx, src, ns.Name, item.Name)
+			}
+
+			diffs = append(diffs, item)
+		}
+	}
+
+	return
+}
+
+// diffTarget computes the replica of the source in the namespace with server-side dry-run, and compares it with the live one,
+// dry-run is authorized as a real apply, it requires patch permission on the resource
+func (s *Session) diffTarget(ctx context.Context, src *unstructured.Unstructured, namespace string, name string) (created bool, skipped bool, diff string, err error) {
+	defer rg.Guard(&err)
+
+	if _, ok := rg.Must2(s.checkConflict(ctx, namespace, name)); !ok {
+		skipped = true
+		return
+	}
+
+	obj := rg.Must(s.createReplicatedResource(src, namespace, name))
+
+	replica := rg.Must(s.dynClient.Resource(s.task.resource).Namespace(namespace).Apply(ctx, name, obj, metaV1.ApplyOptions{
+		Force:        true,
+		FieldManager: FieldManagerReplikator,
+		DryRun:       []string{metaV1.DryRunAll},
+	}))
+
+	diff, created, err = s.diffReplica(ctx, replica)
+	return
+}
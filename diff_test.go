@@ -0,0 +1,43 @@
+package replikator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDiffResources(t *testing.T) {
+	desired := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"namespace": "team-a",
+			"name":      "ca-bundle",
+		},
+		"data": map[string]any{"ca.crt": "new"},
+	}}
+
+	diff, err := diffResources(nil, desired)
+	require.NoError(t, err)
+	require.Contains(t, diff, "+++ replica")
+	require.Contains(t, diff, "+  ca.crt: new")
+
+	live := desired.DeepCopy()
+	live.SetResourceVersion("123")
+	live.SetUID("uid")
+	live.SetManagedFields([]metaV1.ManagedFieldsEntry{{Manager: FieldManagerReplikator}})
+
+	diff, err = diffResources(live, desired)
+	require.NoError(t, err)
+	require.Empty(t, diff)
+
+	require.NoError(t, unstructured.SetNestedField(live.Object, "old", "data", "ca.crt"))
+
+	diff, err = diffResources(live, desired)
+	require.NoError(t, err)
+	require.Contains(t, diff, "--- live")
+	require.Contains(t, diff, "-  ca.crt: old")
+	require.Contains(t, diff, "+  ca.crt: new")
+}
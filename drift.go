@@ -0,0 +1,121 @@
+package replikator
+
+import (
+	"sync"
+)
+
+// replicaTracker tracks resource versions of replicas applied by the session, for drift detection,
+// it's shared by the synchronization loop and the replica watch
+type replicaTracker struct {
+	lock    sync.Mutex
+	applied map[string]string
+	pending map[string][]replicaChange
+	drifted map[string]struct{}
+}
+
+// replicaChange is a change of the replica observed while the session is applying it
+type replicaChange struct {
+	resourceVersion string
+	deleted         bool
+}
+
+// beginApply records the replica is being written by the session, the watch may deliver the change before Apply returns,
+// changes observed until setApplied or cancelApply are resolved by them
+func (t *replicaTracker) beginApply(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.pending == nil {
+		t.pending = map[string][]replicaChange{}
+	}
+	t.pending[key] = []replicaChange{}
+}
+
+// setApplied records the resource version of the replica written by the session,
+// changes observed after the write while applying are drifted, earlier ones are overwritten by the write
+func (t *replicaTracker) setApplied(key string, resourceVersion string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.applied == nil {
+		t.applied = map[string]string{}
+	}
+	t.applied[key] = resourceVersion
+
+	changes := t.pending[key]
+	delete(t.pending, key)
+
+	for i, change := range changes {
+		if change.resourceVersion == resourceVersion && !change.deleted {
+			if i < len(changes)-1 {
+				t.markDrifted(key)
+			}
+			break
+		}
+	}
+}
+
+// cancelApply ends the write of the replica failed, changes observed while applying are compared as usual
+func (t *replicaTracker) cancelApply(key string) {
+	t.lock.Lock()
+	changes := t.pending[key]
+	delete(t.pending, key)
+	t.lock.Unlock()
+
+	for _, change := range changes {
+		t.observe(key, change.resourceVersion, change.deleted)
+	}
+}
+
+func (t *replicaTracker) markDrifted(key string) {
+	if t.drifted == nil {
+		t.drifted = map[string]struct{}{}
+	}
+	t.drifted[key] = struct{}{}
+}
+
+// forget stops tracking the replica, e.g. pruned by the session
+func (t *replicaTracker) forget(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.applied, key)
+	delete(t.drifted, key)
+}
+
+// observe records a change of the replica, returns true if it's not written by the session,
+// replicas not applied by the session are ignored, deleted replicas are always drifted,
+// changes of replicas being applied are deferred to setApplied or cancelApply
+func (t *replicaTracker) observe(key string, resourceVersion string, deleted bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if changes, ok := t.pending[key]; ok {
+		t.pending[key] = append(changes, replicaChange{resourceVersion: resourceVersion, deleted: deleted})
+		return false
+	}
+
+	applied, ok := t.applied[key]
+	if !ok || (!deleted && applied == resourceVersion) {
+		return false
+	}
+
+	if deleted {
+		delete(t.applied, key)
+	}
+
+	t.markDrifted(key)
+	return true
+}
+
+// takeDrifted returns true and clears the mark, if the replica drifted since last synchronization
+func (t *replicaTracker) takeDrifted(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.drifted[key]; ok {
+		delete(t.drifted, key)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package replikator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaTracker(t *testing.T) {
+	tracker := &replicaTracker{}
+
+	// replicas not applied by the session are ignored
+	require.False(t, tracker.observe("team-a/registry-credentials", "1", false))
+	require.False(t, tracker.observe("team-a/registry-credentials", "1", true))
+	require.False(t, tracker.takeDrifted("team-a/registry-credentials"))
+
+	tracker.setApplied("team-a/registry-credentials", "2")
+
+	// changes written by the session are ignored
+	require.False(t, tracker.observe("team-a/registry-credentials", "2", false))
+	require.False(t, tracker.takeDrifted("team-a/registry-credentials"))
+
+	// changes written by others
+	require.True(t, tracker.observe("team-a/registry-credentials", "3", false))
+	require.True(t, tracker.takeDrifted("team-a/registry-credentials"))
+	require.False(t, tracker.takeDrifted("team-a/registry-credentials"))
+
+	// deleted
+	require.True(t, tracker.observe("team-a/registry-credentials", "3", true))
+	require.True(t, tracker.takeDrifted("team-a/registry-credentials"))
+	require.False(t, tracker.observe("team-a/registry-credentials", "4", false))
+
+	// pruned by the session
+	tracker.setApplied("team-b/registry-credentials", "5")
+	tracker.forget("team-b/registry-credentials")
+	require.False(t, tracker.observe("team-b/registry-credentials", "5", true))
+	require.False(t, tracker.takeDrifted("team-b/registry-credentials"))
+}
+
+func TestReplicaTrackerApplying(t *testing.T) {
+	tracker := &replicaTracker{}
+
+	// own write delivered before Apply returns
+	tracker.beginApply("team-a/registry-credentials")
+	require.False(t, tracker.observe("team-a/registry-credentials", "2", false))
+	tracker.setApplied("team-a/registry-credentials", "2")
+	require.False(t, tracker.takeDrifted("team-a/registry-credentials"))
+	require.False(t, tracker.observe("team-a/registry-credentials", "2", false))
+
+	// changes before the write are overwritten
+	tracker.beginApply("team-a/registry-credentials")
+	require.False(t, tracker.observe("team-a/registry-credentials", "3", false))
+	require.False(t, tracker.observe("team-a/registry-credentials", "4", false))
+	tracker.setApplied("team-a/registry-credentials", "4")
+	require.False(t, tracker.takeDrifted("team-a/registry-credentials"))
+
+	// changes after the write are drifted
+	tracker.beginApply("team-a/registry-credentials")
+	require.False(t, tracker.observe("team-a/registry-credentials", "5", false))
+	require.False(t, tracker.observe("team-a/registry-credentials", "6", false))
+	tracker.setApplied("team-a/registry-credentials", "5")
+	require.True(t, tracker.takeDrifted("team-a/registry-credentials"))
+
+	// own write delivered after Apply returns
+	tracker.beginApply("team-a/registry-credentials")
+	tracker.setApplied("team-a/registry-credentials", "7")
+	require.False(t, tracker.observe("team-a/registry-credentials", "7", false))
+	require.False(t, tracker.takeDrifted("team-a/registry-credentials"))
+
+	// write failed, changes of others are drifted
+	tracker.beginApply("team-a/registry-credentials")
+	require.False(t, tracker.observe("team-a/registry-credentials", "8", false))
+	tracker.cancelApply("team-a/registry-credentials")
+	require.True(t, tracker.takeDrifted("team-a/registry-credentials"))
+}
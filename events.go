@@ -0,0 +1,56 @@
+package replikator
+
+import (
+	"context"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCoreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// reasons of Kubernetes Events recorded by replikator
+const (
+	EventReasonReplicated        = "Replicated"
+	EventReasonReplicationFailed = "ReplicationFailed"
+	EventReasonConflict          = "ReplicationConflict"
+	EventReasonPruned            = "Pruned"
+	EventReasonPruneFailed       = "PruneFailed"
+)
+
+// NewEventRecorder creates an EventRecorder writing Kubernetes Events, call shutdown to flush and stop
+func NewEventRecorder(client kubernetes.Interface) (recorder record.EventRecorder, shutdown func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedCoreV1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder = broadcaster.NewRecorder(scheme.Scheme, coreV1.EventSource{Component: "replikator"})
+	shutdown = broadcaster.Shutdown
+	return
+}
+
+// event records an event on the object, if event recorder is set
+func (s *Session) event(obj runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	if s.recorder == nil {
+		return
+	}
+	s.recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+// eventReplica records an event on the replica, the existing one is retrieved for uid, so that it shows up in 'kubectl describe'
+func (s *Session) eventReplica(ctx context.Context, src *unstructured.Unstructured, namespace, name string, eventType, reason, messageFmt string, args ...any) {
+	if s.recorder == nil {
+		return
+	}
+	obj, err := s.dynClient.Resource(s.task.resource).Namespace(namespace).Get(ctx, name, metaV1.GetOptions{})
+	if err != nil {
+		obj = &unstructured.Unstructured{Object: map[string]any{}}
+		obj.SetAPIVersion(src.GetAPIVersion())
+		obj.SetKind(src.GetKind())
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+	}
+	s.event(obj, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,28 @@
+package replikator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSessionEvent(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+	}}
+	obj.SetNamespace("team-a")
+	obj.SetName("registry-credentials")
+
+	// no recorder
+	s := &Session{}
+	s.event(obj, coreV1.EventTypeNormal, EventReasonReplicated, "Replicated from %s", "default/registry-credentials")
+
+	recorder := record.NewFakeRecorder(1)
+	s.recorder = recorder
+	s.event(obj, coreV1.EventTypeWarning, EventReasonReplicationFailed, "Replication of %s failed: %s", "default/registry-credentials", "quota exceeded")
+	require.Equal(t, "Warning ReplicationFailed Replication of default/registry-credentials failed: quota exceeded", <-recorder.Events)
+}
@@ -1,31 +1,81 @@
 package replikator
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/yankeguo/rg"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// LeaderElectionFlags is the flags for Lease based leader election
+type LeaderElectionFlags struct {
+	Enabled       bool
+	LeaseName     string
+	Namespace     string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
 type Flags struct {
-	Conf       string
-	Kubeconfig struct {
+	Conf            string
+	CRD             bool
+	CRDResources    []string
+	DryRun          bool
+	Listen          string
+	StatusConfigMap types.NamespacedName
+	Kubeconfig      struct {
 		Path      string
 		InCluster bool
 	}
+	Prune struct {
+		GracePeriod time.Duration
+		DryRun      bool
+	}
+	Resync struct {
+		Period time.Duration
+		Jitter float64
+	}
+	Retry struct {
+		BaseDelay time.Duration
+		MaxDelay  time.Duration
+	}
+	LeaderElection LeaderElectionFlags
 }
 
-func ParseFlags() (flags Flags, err error) {
-	flag.StringVar(&flags.Kubeconfig.Path, "kubeconfig", "", "(optional) absolute path to the kubeconfig file")
-	flag.StringVar(&flags.Conf, "conf", ".", "absolute path to the configuration directory")
-	flag.Parse()
+// registerKubeconfigFlags registers flags shared by all commands connecting to the cluster
+func (flags *Flags) registerKubeconfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flags.Kubeconfig.Path, "kubeconfig", "", "(optional) absolute path to the kubeconfig file")
+	fs.StringVar(&flags.Conf, "conf", ".", "absolute path to the configuration directory")
+	fs.BoolVar(&flags.CRD, "crd", false, "load task definitions from Replication custom resources")
+	flags.CRDResources = DefaultReplicationResources
+	fs.Func("crd-resources", "comma separated resources allowed to be replicated by Replication custom resources (default \""+strings.Join(DefaultReplicationResources, ",")+"\")", func(s string) error {
+		flags.CRDResources = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			if _, err := ParseGroupVersionResource(item); err != nil {
+				return err
+			}
+			flags.CRDResources = append(flags.CRDResources, item)
+		}
+		return nil
+	})
+}
 
+// resolveKubeconfig expands paths and resolves kubeconfig from environment
+func (flags *Flags) resolveKubeconfig() (err error) {
 	flags.Conf = os.ExpandEnv(flags.Conf)
 	flags.Kubeconfig.Path = os.ExpandEnv(flags.Kubeconfig.Path)
 
@@ -45,6 +95,75 @@ func ParseFlags() (flags Flags, err error) {
 	return
 }
 
+// ParseFlags parses flags of the main command from arguments, without the program name
+func ParseFlags(args []string) (flags Flags, err error) {
+	fs := flag.NewFlagSet("replikator", flag.ExitOnError)
+	flags.registerKubeconfigFlags(fs)
+	fs.BoolVar(&flags.DryRun, "dry-run", false, "only log planned changes of all tasks, nothing is persisted")
+	fs.StringVar(&flags.Listen, "listen", ":8080", "address of http server for metrics, empty to disable")
+	fs.Func("status-configmap", "(optional) 'namespace/name' of the ConfigMap to write status of tasks from configuration files", func(s string) error {
+		namespace, name, ok := strings.Cut(s, "/")
+		if !ok || namespace == "" || name == "" {
+			return errors.New("invalid status configmap: " + s)
+		}
+		flags.StatusConfigMap = types.NamespacedName{Namespace: namespace, Name: name}
+		return nil
+	})
+	fs.DurationVar(&flags.Prune.GracePeriod, "prune-grace-period", 10*time.Minute, "how long a replica must stay orphaned before being pruned")
+	fs.BoolVar(&flags.Prune.DryRun, "prune-dry-run", false, "only log orphaned replicas instead of pruning them")
+	fs.DurationVar(&flags.Resync.Period, "resync-period", DefaultResyncPeriod, "period of full synchronizations of tasks without resyncPeriod, 0 to disable")
+	fs.Float64Var(&flags.Resync.Jitter, "resync-jitter", DefaultResyncJitter, "jitter factor of full synchronizations, each period is extended randomly up to the factor, 0 to disable")
+	fs.DurationVar(&flags.Retry.BaseDelay, "retry-base-delay", DefaultRetryBaseDelay, "initial delay of retrying failed synchronizations, doubled on each failure")
+	fs.DurationVar(&flags.Retry.MaxDelay, "retry-max-delay", DefaultRetryMaxDelay, "maximum delay of retrying failed synchronizations")
+	fs.BoolVar(&flags.LeaderElection.Enabled, "leader-elect", false, "enable Lease based leader election, for running multiple replicas")
+	fs.StringVar(&flags.LeaderElection.LeaseName, "leader-elect-lease-name", "replikator", "name of the Lease for leader election")
+	fs.StringVar(&flags.LeaderElection.Namespace, "leader-elect-namespace", "", "namespace of the Lease for leader election, default to namespace of the service account")
+	fs.DurationVar(&flags.LeaderElection.LeaseDuration, "leader-elect-lease-duration", 15*time.Second, "duration that non-leader candidates will wait to force acquire leadership")
+	fs.DurationVar(&flags.LeaderElection.RenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "duration that the leader will retry refreshing leadership before giving up")
+	fs.DurationVar(&flags.LeaderElection.RetryPeriod, "leader-elect-retry-period", 2*time.Second, "duration between leader election actions")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	if flags.Resync.Period < 0 {
+		err = errors.New("resync-period must not be negative")
+		return
+	}
+	if flags.Resync.Jitter < 0 {
+		err = errors.New("resync-jitter must not be negative")
+		return
+	}
+	if flags.Retry.BaseDelay <= 0 || flags.Retry.MaxDelay < flags.Retry.BaseDelay {
+		err = errors.New("retry-base-delay must be positive, and not greater than retry-max-delay")
+		return
+	}
+
+	if flags.LeaderElection.Enabled && flags.LeaderElection.Namespace == "" {
+		buf, _ := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if len(buf) > 0 {
+			flags.LeaderElection.Namespace = string(bytes.TrimSpace(buf))
+		} else {
+			err = errors.New("leader-elect-namespace is required")
+			return
+		}
+	}
+
+	err = flags.resolveKubeconfig()
+	return
+}
+
+// ParseDiffFlags parses flags of the 'diff' command from arguments, without the program and command name
+func ParseDiffFlags(args []string) (flags Flags, err error) {
+	fs := flag.NewFlagSet("replikator diff", flag.ExitOnError)
+	flags.registerKubeconfigFlags(fs)
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	err = flags.resolveKubeconfig()
+	return
+}
+
 func (flags Flags) CreateKubernetesClient() (client *kubernetes.Clientset, dynClient *dynamic.DynamicClient, err error) {
 	defer rg.Guard(&err)
 
@@ -60,3 +179,62 @@ func (flags Flags) CreateKubernetesClient() (client *kubernetes.Clientset, dynCl
 	dynClient = rg.Must(dynamic.NewForConfig(conf))
 	return
 }
+
+// TestModificationFlags is the flags of the 'test-modification' command
+type TestModificationFlags struct {
+	Task          string
+	ID            string
+	Input         string
+	Namespace     string
+	NamespaceFile string
+}
+
+// ParseTestModificationFlags parses flags of the 'test-modification' command from arguments, without the program and command name
+func ParseTestModificationFlags(args []string) (flags TestModificationFlags, err error) {
+	fs := flag.NewFlagSet("replikator test-modification", flag.ExitOnError)
+	fs.StringVar(&flags.Task, "task", "", "path to the task definition file")
+	fs.StringVar(&flags.ID, "id", "", "(optional) id of the task, required if the file contains multiple tasks")
+	fs.StringVar(&flags.Input, "input", "", "path to the input resource file, YAML or JSON")
+	fs.StringVar(&flags.Namespace, "namespace", "default", "target namespace of the replica")
+	fs.StringVar(&flags.NamespaceFile, "namespace-file", "", "(optional) path to the target namespace file, YAML or JSON, with labels and annotations, overrides --namespace")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	flags.Task = os.ExpandEnv(flags.Task)
+	flags.Input = os.ExpandEnv(flags.Input)
+	flags.NamespaceFile = os.ExpandEnv(flags.NamespaceFile)
+
+	if flags.Task == "" {
+		err = errors.New("task is required")
+		return
+	}
+	if flags.Input == "" {
+		err = errors.New("input is required")
+		return
+	}
+	return
+}
+
+// ValidateFlags is the flags of the 'validate' command
+type ValidateFlags struct {
+	Conf  string
+	Files []string
+}
+
+// ParseValidateFlags parses flags of the 'validate' command from arguments, without the program and command name
+func ParseValidateFlags(args []string) (flags ValidateFlags, err error) {
+	fs := flag.NewFlagSet("replikator validate", flag.ExitOnError)
+	fs.StringVar(&flags.Conf, "conf", "", "absolute path to the configuration directory, optional if files are given")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	flags.Conf = os.ExpandEnv(flags.Conf)
+	flags.Files = fs.Args()
+
+	if flags.Conf == "" && len(flags.Files) == 0 {
+		flags.Conf = "."
+	}
+	return
+}
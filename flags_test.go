@@ -0,0 +1,74 @@
+package replikator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFlags(t *testing.T) {
+	flags, err := ParseFlags([]string{"--kubeconfig", "/tmp/kubeconfig", "--conf", "/tmp/conf", "--dry-run", "--status-configmap", "default/replikator-status"})
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/kubeconfig", flags.Kubeconfig.Path)
+	require.Equal(t, "/tmp/conf", flags.Conf)
+	require.True(t, flags.DryRun)
+	require.Equal(t, "default", flags.StatusConfigMap.Namespace)
+	require.Equal(t, "replikator-status", flags.StatusConfigMap.Name)
+	require.Equal(t, ":8080", flags.Listen)
+	require.Equal(t, DefaultResyncPeriod, flags.Resync.Period)
+	require.Equal(t, DefaultRetryBaseDelay, flags.Retry.BaseDelay)
+
+	flags, err = ParseFlags([]string{"--kubeconfig", "/tmp/kubeconfig", "--resync-period", "0", "--retry-max-delay", "1m"})
+	require.NoError(t, err)
+	require.Zero(t, flags.Resync.Period)
+	require.Equal(t, time.Minute, flags.Retry.MaxDelay)
+
+	_, err = ParseFlags([]string{"--kubeconfig", "/tmp/kubeconfig", "--retry-base-delay", "10m"})
+	require.Error(t, err)
+}
+
+func TestParseDiffFlags(t *testing.T) {
+	flags, err := ParseDiffFlags([]string{"--kubeconfig", "/tmp/kubeconfig", "--conf", "/tmp/conf", "--crd"})
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/kubeconfig", flags.Kubeconfig.Path)
+	require.Equal(t, "/tmp/conf", flags.Conf)
+	require.True(t, flags.CRD)
+	require.Equal(t, DefaultReplicationResources, flags.CRDResources)
+
+	flags, err = ParseDiffFlags([]string{"--kubeconfig", "/tmp/kubeconfig", "--crd-resources", "secrets, apps/deployments"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"secrets", "apps/deployments"}, flags.CRDResources)
+}
+
+func TestParseTestModificationFlags(t *testing.T) {
+	flags, err := ParseTestModificationFlags([]string{"--task", "task.yaml", "--input", "obj.yaml"})
+	require.NoError(t, err)
+	require.Equal(t, "task.yaml", flags.Task)
+	require.Equal(t, "obj.yaml", flags.Input)
+	require.Equal(t, "default", flags.Namespace)
+	require.Empty(t, flags.NamespaceFile)
+
+	flags, err = ParseTestModificationFlags([]string{"--task", "task.yaml", "--input", "obj.yaml", "--namespace-file", "ns.yaml"})
+	require.NoError(t, err)
+	require.Equal(t, "ns.yaml", flags.NamespaceFile)
+
+	_, err = ParseTestModificationFlags([]string{"--task", "task.yaml"})
+	require.Error(t, err)
+}
+
+func TestParseValidateFlags(t *testing.T) {
+	flags, err := ParseValidateFlags([]string{"--conf", "/tmp/conf"})
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/conf", flags.Conf)
+	require.Empty(t, flags.Files)
+
+	flags, err = ParseValidateFlags([]string{"a.yaml", "b.yaml"})
+	require.NoError(t, err)
+	require.Empty(t, flags.Conf)
+	require.Equal(t, []string{"a.yaml", "b.yaml"}, flags.Files)
+
+	flags, err = ParseValidateFlags(nil)
+	require.NoError(t, err)
+	require.Equal(t, ".", flags.Conf)
+}
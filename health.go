@@ -0,0 +1,110 @@
+package replikator
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// WatchDisconnectTolerance is how long watches of a session can keep failing before considered unhealthy
+const WatchDisconnectTolerance = time.Minute
+
+// watchHealth tracks failures of a shared watch, used by multiple sessions
+type watchHealth struct {
+	name string
+
+	lock        sync.Mutex
+	failing     time.Time
+	lastFailure time.Time
+}
+
+// failed records a failure of the watch, consecutive failures are considered as a single disconnection,
+// failures are retried with backoff up to a minute, so failures within twice the tolerance are consecutive
+func (h *watchHealth) failed(now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.failing.IsZero() || now.Sub(h.lastFailure) >= 2*WatchDisconnectTolerance {
+		h.failing = now
+	}
+	h.lastFailure = now
+}
+
+// recovered records an event delivered by the watch
+func (h *watchHealth) recovered() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.failing = time.Time{}
+}
+
+func (h *watchHealth) healthy(now time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.failing.IsZero() ||
+		now.Sub(h.lastFailure) >= 2*WatchDisconnectTolerance ||
+		now.Sub(h.failing) < WatchDisconnectTolerance
+}
+
+// sessionHealth tracks watches and initial synchronization of a session
+type sessionHealth struct {
+	lock    sync.Mutex
+	watches []*watchHealth
+	synced  bool
+}
+
+func (h *sessionHealth) setWatches(watches ...*watchHealth) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.watches = watches
+}
+
+func (h *sessionHealth) setSynced() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.synced = true
+}
+
+// unhealthyWatch returns the name of the first watch failing for too long, empty if all healthy
+func (h *sessionHealth) unhealthyWatch(now time.Time) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, watch := range h.watches {
+		if !watch.healthy(now) {
+			return watch.name
+		}
+	}
+	return ""
+}
+
+func (h *sessionHealth) ready() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.synced
+}
+
+// Healthy checks whether watches of all sessions are connected, or reconnecting within WatchDisconnectTolerance
+func (list SessionList) Healthy() error {
+	now := time.Now()
+	for _, session := range list {
+		if name := session.health.unhealthyWatch(now); name != "" {
+			return errors.New("watch of " + name + " for task " + session.task.id + " disconnected")
+		}
+	}
+	return nil
+}
+
+// Ready checks whether initial synchronization of all sessions was attempted, failed or not
+func (list SessionList) Ready() error {
+	for _, session := range list {
+		if !session.health.ready() {
+			return errors.New("task " + session.task.id + " not synchronized")
+		}
+	}
+	return nil
+}
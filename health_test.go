@@ -0,0 +1,77 @@
+package replikator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	listersCoreV1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSessionListHealth(t *testing.T) {
+	s := &Session{task: &Task{id: "test-task"}}
+	list := SessionList{s}
+
+	// not started
+	require.NoError(t, list.Healthy())
+	require.Error(t, list.Ready())
+
+	watch := &watchHealth{name: "namespaces"}
+	s.health.setWatches(watch)
+	require.NoError(t, list.Healthy())
+
+	now := time.Now()
+
+	// failing within tolerance
+	watch.failed(now.Add(-WatchDisconnectTolerance / 2))
+	require.NoError(t, list.Healthy())
+
+	// failing for too long
+	watch.failing = now.Add(-WatchDisconnectTolerance * 2)
+	require.ErrorContains(t, list.Healthy(), "watch of namespaces for task test-task disconnected")
+
+	// events delivered
+	watch.recovered()
+	require.NoError(t, list.Healthy())
+
+	s.health.setSynced()
+	require.NoError(t, list.Ready())
+}
+
+func TestWatchHealth(t *testing.T) {
+	now := time.Now()
+
+	h := &watchHealth{name: "secrets"}
+	require.True(t, h.healthy(now))
+
+	// consecutive failures
+	h.failed(now.Add(-90 * time.Second))
+	h.failed(now.Add(-30 * time.Second))
+	require.False(t, h.healthy(now))
+
+	// failures stopped, reconnected without events
+	require.True(t, h.healthy(now.Add(2*WatchDisconnectTolerance)))
+
+	// failures after a long pause start a new disconnection
+	h.failed(now.Add(2 * WatchDisconnectTolerance))
+	require.True(t, h.healthy(now.Add(2*WatchDisconnectTolerance+time.Second)))
+}
+
+func TestSessionSyncReady(t *testing.T) {
+	tasks, err := TaskDefinitionList{testControllerDefinition("task-a", false)}.Build()
+	require.NoError(t, err)
+
+	s := tasks[0].NewSession(TaskOptions{})
+	s.namespaceLister = listersCoreV1.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	s.sourceLister = cache.NewGenericLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+	}), schema.GroupResource{Resource: "secrets"})
+
+	// source not found, failed but attempted
+	_, err = s.sync(context.Background(), "")
+	require.Error(t, err)
+	require.NoError(t, SessionList{s}.Ready())
+}
@@ -0,0 +1,71 @@
+package replikator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricReplicationAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "replication_attempts_total",
+		Help:      "Number of replications attempted, per task and target namespace",
+	}, []string{"task", "namespace"})
+
+	metricReplicationSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "replication_successes_total",
+		Help:      "Number of replications succeeded, per task and target namespace",
+	}, []string{"task", "namespace"})
+
+	metricReplicationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "replication_failures_total",
+		Help:      "Number of replications failed, per task and target namespace",
+	}, []string{"task", "namespace"})
+
+	metricReplicationGiveUps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "replication_give_ups_total",
+		Help:      "Number of replications given up after retries, per task and target namespace",
+	}, []string{"task", "namespace"})
+
+	metricApplyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "replikator",
+		Name:      "apply_duration_seconds",
+		Help:      "Latency of applying replicas, per task",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"task"})
+
+	metricJavaScriptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "replikator",
+		Name:      "javascript_duration_seconds",
+		Help:      "Duration of javascript modifications, per task",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2},
+	}, []string{"task"})
+
+	metricJavaScriptTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "javascript_timeouts_total",
+		Help:      "Number of javascript modifications timed out, per task",
+	}, []string{"task"})
+
+	metricWatchRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "watch_restarts_total",
+		Help:      "Number of watch restarts, per task",
+	}, []string{"task"})
+
+	metricActiveSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "replikator",
+		Name:      "active_sessions",
+		Help:      "Number of active sessions",
+	})
+
+	// MetricConfigReloads counts reloads of task definitions
+	MetricConfigReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "replikator",
+		Name:      "config_reloads_total",
+		Help:      "Number of task definitions reloads",
+	})
+)
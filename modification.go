@@ -2,6 +2,7 @@ package replikator
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/robertkrimen/otto"
@@ -13,6 +14,21 @@ var (
 	ErrScriptTimeout = errors.New("script timeout")
 )
 
+// JavaScriptFilename is the filename of modification scripts, shown in locations of errors
+const JavaScriptFilename = "modification.javascript"
+
+// withJavaScriptLocation appends locations of the stack to runtime errors of scripts, e.g. 'Error: boom at modification.javascript:2:11'
+func withJavaScriptLocation(err error) error {
+	if e, ok := err.(*otto.Error); ok {
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(e.String()), "\n") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		return errors.New(strings.Join(lines, " "))
+	}
+	return err
+}
+
 // EvaluateJavaScriptModification evaluates the javascript modification script on the src, input and output are both JSON string
 func EvaluateJavaScriptModification(src string, script string) (out string, err error) {
 	defer rg.Guard(&err)
@@ -40,7 +56,12 @@ func EvaluateJavaScriptModification(src string, script string) (out string, err
 	if _, err = vm.Run("var resource = JSON.parse(raw_resource);"); err != nil {
 		return
 	}
-	if _, err = vm.Run(script); err != nil {
+	var compiled *otto.Script
+	if compiled, err = vm.Compile(JavaScriptFilename, script); err != nil {
+		return
+	}
+	if _, err = vm.Run(compiled); err != nil {
+		err = withJavaScriptLocation(err)
 		return
 	}
 	var val otto.Value
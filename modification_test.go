@@ -39,3 +39,13 @@ func TestEvaluateJavaScriptModificationTimeout(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, ErrScriptTimeout, err)
 }
+
+func TestEvaluateJavaScriptModificationError(t *testing.T) {
+	_, err := EvaluateJavaScriptModification(`{}`, "var a = 1;\nresource.hello.world = 1;")
+	require.Error(t, err)
+	require.Equal(t, `TypeError: Cannot access member "world" of undefined at modification.javascript:2:1`, err.Error())
+
+	_, err = EvaluateJavaScriptModification(`{}`, "var a = 1;\n  a b c")
+	require.Error(t, err)
+	require.Equal(t, "modification.javascript: Line 2:5 Unexpected identifier", err.Error())
+}
@@ -0,0 +1,113 @@
+package replikator
+
+import (
+	"errors"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// LabelManaged marks a resource as a replica created by replikator
+	LabelManaged = "replikator.yankeguo.io/managed"
+	// LabelTask is the id of the task which created the replica
+	LabelTask = "replikator.yankeguo.io/task"
+	// LabelSourceNamespace is the namespace of the source resource
+	LabelSourceNamespace = "replikator.yankeguo.io/source-namespace"
+	// LabelPrune marks a replica as prunable once it no longer belongs to its task
+	LabelPrune = "replikator.yankeguo.io/prune"
+
+	// AnnotationTask is the id of the task which created the replica
+	AnnotationTask = "replikator.yankeguo.io/task"
+	// AnnotationSourceResource is the group version resource of the source resource
+	AnnotationSourceResource = "replikator.yankeguo.io/source-resource"
+	// AnnotationSourceNamespace is the namespace of the source resource
+	AnnotationSourceNamespace = "replikator.yankeguo.io/source-namespace"
+	// AnnotationSourceName is the name of the source resource
+	AnnotationSourceName = "replikator.yankeguo.io/source-name"
+	// AnnotationSourceResourceVersion is the resource version of the source resource when replicated
+	AnnotationSourceResourceVersion = "replikator.yankeguo.io/source-resource-version"
+	// AnnotationAdopt allows replikator to take over a pre-existing resource, with conflict policy adopt-if-annotated
+	AnnotationAdopt = "replikator.yankeguo.io/adopt"
+)
+
+// ConflictPolicy decides what to do when the target resource exists and is not owned by the task
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyOverwrite overwrites the existing resource
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite"
+	// ConflictPolicySkip leaves the existing resource untouched
+	ConflictPolicySkip ConflictPolicy = "skip"
+	// ConflictPolicyAdoptIfAnnotated overwrites the existing resource only if it's annotated with AnnotationAdopt
+	ConflictPolicyAdoptIfAnnotated ConflictPolicy = "adopt-if-annotated"
+)
+
+// ParseConflictPolicy parse a string to ConflictPolicy, empty string defaults to ConflictPolicyOverwrite
+func ParseConflictPolicy(s string) (policy ConflictPolicy, err error) {
+	switch policy = ConflictPolicy(s); policy {
+	case "":
+		policy = ConflictPolicyOverwrite
+	case ConflictPolicyOverwrite, ConflictPolicySkip, ConflictPolicyAdoptIfAnnotated:
+	default:
+		err = errors.New("invalid conflict policy: " + s)
+	}
+	return
+}
+
+// isReplicatedResource checks whether the object was written by replikator
+func isReplicatedResource(obj *unstructured.Unstructured) bool {
+	for _, field := range obj.GetManagedFields() {
+		if field.Manager == FieldManagerReplikator {
+			return true
+		}
+	}
+	return false
+}
+
+// markReplica stamps the replica with labels and annotations describing its source and task
+func (t *Task) markReplica(obj *unstructured.Unstructured, source *unstructured.Unstructured) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[LabelManaged] = "true"
+	labels[LabelTask] = t.id
+	labels[LabelSourceNamespace] = t.srcNamespace
+	if t.prune {
+		labels[LabelPrune] = "true"
+	}
+	obj.SetLabels(labels)
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[AnnotationTask] = t.id
+	annotations[AnnotationSourceResource] = t.resource.String()
+	annotations[AnnotationSourceNamespace] = t.srcNamespace
+	annotations[AnnotationSourceName] = source.GetName()
+	annotations[AnnotationSourceResourceVersion] = source.GetResourceVersion()
+	obj.SetAnnotations(annotations)
+}
+
+// ownsReplica checks whether the object is a replica created by the task,
+// replicas created before ownership marking are recognized by field manager
+func (t *Task) ownsReplica(obj *unstructured.Unstructured) bool {
+	labels := obj.GetLabels()
+	if labels[LabelManaged] == "true" {
+		return labels[LabelTask] == t.id
+	}
+	return isReplicatedResource(obj)
+}
+
+// canOverwrite checks whether the existing resource can be overwritten by the task, according to the conflict policy
+func (t *Task) canOverwrite(obj *unstructured.Unstructured) bool {
+	switch t.conflictPolicy {
+	case ConflictPolicySkip:
+		return t.ownsReplica(obj)
+	case ConflictPolicyAdoptIfAnnotated:
+		return t.ownsReplica(obj) || obj.GetAnnotations()[AnnotationAdopt] == "true"
+	default:
+		return true
+	}
+}
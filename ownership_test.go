@@ -0,0 +1,108 @@
+package replikator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestIsReplicatedResource(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]any{}}
+	require.False(t, isReplicatedResource(obj))
+
+	obj.SetManagedFields([]metaV1.ManagedFieldsEntry{{Manager: "kubectl-client-side-apply"}})
+	require.False(t, isReplicatedResource(obj))
+
+	obj.SetManagedFields([]metaV1.ManagedFieldsEntry{{Manager: "kubectl-client-side-apply"}, {Manager: FieldManagerReplikator}})
+	require.True(t, isReplicatedResource(obj))
+}
+
+func TestTaskMarkReplica(t *testing.T) {
+	def := TaskDefinition{}
+	def.ID = "test-task"
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = ".+"
+	tsk, err := def.Build()
+	require.NoError(t, err)
+
+	src := &unstructured.Unstructured{Object: map[string]any{}}
+	src.SetName("registry-credentials")
+	src.SetResourceVersion("123")
+
+	obj := &unstructured.Unstructured{Object: map[string]any{}}
+	obj.SetLabels(map[string]string{"app": "demo"})
+	tsk.markReplica(obj, src)
+
+	require.Equal(t, map[string]string{
+		"app":                "demo",
+		LabelManaged:         "true",
+		LabelTask:            "test-task",
+		LabelSourceNamespace: "default",
+	}, obj.GetLabels())
+	require.Equal(t, map[string]string{
+		AnnotationTask:                  "test-task",
+		AnnotationSourceResource:        "/v1, Resource=secrets",
+		AnnotationSourceNamespace:       "default",
+		AnnotationSourceName:            "registry-credentials",
+		AnnotationSourceResourceVersion: "123",
+	}, obj.GetAnnotations())
+
+	require.True(t, tsk.ownsReplica(obj))
+
+	obj.SetLabels(map[string]string{LabelManaged: "true", LabelTask: "another-task"})
+	require.False(t, tsk.ownsReplica(obj))
+
+	obj.SetLabels(nil)
+	require.False(t, tsk.ownsReplica(obj))
+
+	obj.SetManagedFields([]metaV1.ManagedFieldsEntry{{Manager: FieldManagerReplikator}})
+	require.True(t, tsk.ownsReplica(obj))
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := ParseConflictPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, ConflictPolicyOverwrite, policy)
+
+	policy, err = ParseConflictPolicy("skip")
+	require.NoError(t, err)
+	require.Equal(t, ConflictPolicySkip, policy)
+
+	policy, err = ParseConflictPolicy("adopt-if-annotated")
+	require.NoError(t, err)
+	require.Equal(t, ConflictPolicyAdoptIfAnnotated, policy)
+
+	_, err = ParseConflictPolicy("replace")
+	require.Error(t, err)
+}
+
+func TestTaskCanOverwrite(t *testing.T) {
+	tsk := &Task{id: "test-task"}
+
+	owned := &unstructured.Unstructured{Object: map[string]any{}}
+	owned.SetLabels(map[string]string{LabelManaged: "true", LabelTask: "test-task"})
+
+	foreign := &unstructured.Unstructured{Object: map[string]any{}}
+
+	annotated := &unstructured.Unstructured{Object: map[string]any{}}
+	annotated.SetAnnotations(map[string]string{AnnotationAdopt: "true"})
+
+	tsk.conflictPolicy = ConflictPolicyOverwrite
+	require.True(t, tsk.canOverwrite(owned))
+	require.True(t, tsk.canOverwrite(foreign))
+	require.True(t, tsk.canOverwrite(annotated))
+
+	tsk.conflictPolicy = ConflictPolicySkip
+	require.True(t, tsk.canOverwrite(owned))
+	require.False(t, tsk.canOverwrite(foreign))
+	require.False(t, tsk.canOverwrite(annotated))
+
+	tsk.conflictPolicy = ConflictPolicyAdoptIfAnnotated
+	require.True(t, tsk.canOverwrite(owned))
+	require.False(t, tsk.canOverwrite(foreign))
+	require.True(t, tsk.canOverwrite(annotated))
+}
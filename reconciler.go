@@ -0,0 +1,311 @@
+package replikator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// ReconcilerOptions is the options for creating a new Reconciler
+type ReconcilerOptions struct {
+	Client        kubernetes.Interface
+	DynamicClient dynamic.Interface
+	// GracePeriod is how long a replica must stay orphaned before being deleted
+	GracePeriod time.Duration
+	// DryRun only logs replicas to be deleted
+	DryRun bool
+	// EventRecorder records Kubernetes Events for pruned replicas, optional
+	EventRecorder record.EventRecorder
+}
+
+// Reconciler deletes prunable replicas which no longer belong to a matching namespace or an existing task,
+// it should be created once and shared across reloads, to keep track of orphaned replicas
+type Reconciler struct {
+	client    kubernetes.Interface
+	dynClient dynamic.Interface
+	grace     time.Duration
+	dryRun    bool
+	recorder  record.EventRecorder
+	log       *logrus.Entry
+
+	lock      sync.Mutex
+	resources map[schema.GroupVersionResource]struct{}
+	orphans   map[string]time.Time
+
+	markLock sync.Mutex
+	marks    map[string]orphanMark
+}
+
+// orphanMark is a replica marked orphaned by a session, e.g. the source is deleted,
+// which can not be told by the replica itself
+type orphanMark struct {
+	res   schema.GroupVersionResource
+	obj   *unstructured.Unstructured
+	since time.Time
+}
+
+func orphanKey(res schema.GroupVersionResource, namespace string, name string) string {
+	return res.String() + "/" + namespace + "/" + name
+}
+
+// markOrphaned marks the replica as orphaned, it's deleted by Reconcile after grace period, unless unmarked,
+// returns false if already marked
+func (r *Reconciler) markOrphaned(res schema.GroupVersionResource, obj *unstructured.Unstructured) bool {
+	if r == nil {
+		return false
+	}
+
+	r.markLock.Lock()
+	defer r.markLock.Unlock()
+
+	key := orphanKey(res, obj.GetNamespace(), obj.GetName())
+	if mark, ok := r.marks[key]; ok && mark.obj.GetUID() == obj.GetUID() {
+		return false
+	}
+	r.marks[key] = orphanMark{res: res, obj: obj, since: time.Now()}
+	return true
+}
+
+// unmarkOrphaned removes the orphan mark of the replica, e.g. replicated again
+func (r *Reconciler) unmarkOrphaned(res schema.GroupVersionResource, namespace string, name string) {
+	if r == nil {
+		return
+	}
+
+	r.markLock.Lock()
+	defer r.markLock.Unlock()
+
+	delete(r.marks, orphanKey(res, namespace, name))
+}
+
+// copyMarks returns a copy of orphan marks
+func (r *Reconciler) copyMarks() map[string]orphanMark {
+	r.markLock.Lock()
+	defer r.markLock.Unlock()
+
+	marks := map[string]orphanMark{}
+	for key, mark := range r.marks {
+		marks[key] = mark
+	}
+	return marks
+}
+
+// NewReconciler creates a new Reconciler
+func NewReconciler(opts ReconcilerOptions) *Reconciler {
+	return &Reconciler{
+		client:    opts.Client,
+		dynClient: opts.DynamicClient,
+		grace:     opts.GracePeriod,
+		dryRun:    opts.DryRun,
+		recorder:  opts.EventRecorder,
+		log:       logrus.WithField("component", "reconciler"),
+		resources: map[schema.GroupVersionResource]struct{}{},
+		orphans:   map[string]time.Time{},
+		marks:     map[string]orphanMark{},
+	}
+}
+
+// isOrphanedReplica checks whether a prunable replica no longer belongs to any of the tasks
+func isOrphanedReplica(tasks TaskList, res schema.GroupVersionResource, obj *unstructured.Unstructured, ns metaV1.Object) bool {
+	id := obj.GetLabels()[LabelTask]
+	for _, task := range tasks {
+		if task.id != id {
+			continue
+		}
+		if !task.prune {
+			return false
+		}
+		// sources no longer matching the selector are pruned by the session
+		srcName := obj.GetAnnotations()[AnnotationSourceName]
+		if task.resource != res ||
+			obj.GetLabels()[LabelSourceNamespace] != task.srcNamespace ||
+			(task.srcSelector == nil && srcName != task.srcName) ||
+			!task.matchNamespace(ns) {
+			return true
+		}
+		// labels and annotations of the source are unknown, keep the replica if target name can not be rendered
+		name, err := task.targetName(&metaV1.ObjectMeta{Name: srcName, Namespace: task.srcNamespace}, ns)
+		return err == nil && name != obj.GetName()
+	}
+	return true
+}
+
+// isDryRunReplica checks whether the replica belongs to a task in dry-run, replicas of such tasks are never deleted
+func isDryRunReplica(tasks TaskList, obj *unstructured.Unstructured) bool {
+	id := obj.GetLabels()[LabelTask]
+	for _, task := range tasks {
+		if task.id == id {
+			return task.dryRun
+		}
+	}
+	return false
+}
+
+// pruneOrphan deletes the orphaned replica if orphaned since longer than grace period, or only logs it in dry-run,
+// returns true if deleted
+func (r *Reconciler) pruneOrphan(ctx context.Context, res schema.GroupVersionResource, obj *unstructured.Unstructured, since time.Time, now time.Time, dryRun bool) bool {
+	log := r.log.WithField("res", res.String()).
+		WithField("dst", obj.GetNamespace()+"/"+obj.GetName()).
+		WithField("task", obj.GetLabels()[LabelTask])
+
+	if now.Sub(since) < r.grace {
+		log.WithField("since", since).Warn("orphaned replica found, waiting for grace period")
+		return false
+	}
+
+	if r.dryRun || dryRun {
+		log.Warn("orphaned replica would be pruned (dry-run)")
+		return false
+	}
+
+	log.Info("pruning orphaned replica")
+
+	uid := obj.GetUID()
+
+	if err := r.dynClient.Resource(res).Namespace(obj.GetNamespace()).Delete(ctx, obj.GetName(), metaV1.DeleteOptions{
+		Preconditions: &metaV1.Preconditions{UID: &uid},
+	}); err != nil && !errors.IsNotFound(err) {
+		log.WithError(err).Error("prune failed")
+		if r.recorder != nil {
+			r.recorder.Eventf(obj, coreV1.EventTypeWarning, EventReasonPruneFailed, "Failed to prune orphaned replica of task %s: %s", obj.GetLabels()[LabelTask], err.Error())
+		}
+		return false
+	}
+
+	if r.recorder != nil {
+		r.recorder.Eventf(obj, coreV1.EventTypeNormal, EventReasonPruned, "Pruned orphaned replica of task %s", obj.GetLabels()[LabelTask])
+	}
+	return true
+}
+
+// Reconcile lists prunable replicas of all known resources, and replicas marked orphaned by sessions,
+// and deletes orphaned ones after grace period
+func (r *Reconciler) Reconcile(ctx context.Context, tasks TaskList) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// resources of removed tasks are remembered, until the process restarts
+	for _, task := range tasks {
+		r.resources[task.resource] = struct{}{}
+	}
+
+	var namespaces *coreV1.NamespaceList
+	if namespaces, err = r.client.CoreV1().Namespaces().List(ctx, metaV1.ListOptions{}); err != nil {
+		return
+	}
+
+	nsIndex := map[string]metaV1.Object{}
+	for _, namespace := range namespaces.Items {
+		nsIndex[namespace.Name] = &namespace
+	}
+
+	now := time.Now()
+
+	marks := r.copyMarks()
+
+	orphans := map[string]time.Time{}
+
+	for res := range r.resources {
+		var list *unstructured.UnstructuredList
+		if list, err = r.dynClient.Resource(res).List(ctx, metaV1.ListOptions{
+			LabelSelector: LabelManaged + "=true," + LabelPrune + "=true",
+		}); err != nil {
+			// resource no longer served
+			if errors.IsNotFound(err) {
+				err = nil
+				delete(r.resources, res)
+				continue
+			}
+			return
+		}
+
+		for _, item := range list.Items {
+			obj := &item
+
+			ns, ok := nsIndex[obj.GetNamespace()]
+			// namespace created after listing, or being deleted
+			if !ok {
+				continue
+			}
+
+			key := orphanKey(res, obj.GetNamespace(), obj.GetName())
+
+			mark, marked := marks[key]
+			delete(marks, key)
+			// replica recreated since marked
+			if marked && mark.obj.GetUID() != obj.GetUID() {
+				r.unmarkOrphaned(res, obj.GetNamespace(), obj.GetName())
+				marked = false
+			}
+
+			if !marked && !isOrphanedReplica(tasks, res, obj, ns) {
+				continue
+			}
+
+			since, ok := r.orphans[key]
+			if !ok {
+				since = now
+			}
+			if marked && mark.since.Before(since) {
+				since = mark.since
+			}
+			orphans[key] = since
+
+			if r.pruneOrphan(ctx, res, obj, since, now, isDryRunReplica(tasks, obj)) {
+				delete(orphans, key)
+				r.unmarkOrphaned(res, obj.GetNamespace(), obj.GetName())
+			}
+		}
+	}
+
+	// replicas marked orphaned, but not listed, e.g. not prunable by labels, or created before ownership marking
+	for key, mark := range marks {
+		var obj *unstructured.Unstructured
+		if obj, err = r.dynClient.Resource(mark.res).Namespace(mark.obj.GetNamespace()).Get(ctx, mark.obj.GetName(), metaV1.GetOptions{}); err != nil {
+			if errors.IsNotFound(err) {
+				r.unmarkOrphaned(mark.res, mark.obj.GetNamespace(), mark.obj.GetName())
+			}
+			err = nil
+			continue
+		}
+		// replica recreated, or taken over by another task since marked
+		if obj.GetUID() != mark.obj.GetUID() || obj.GetLabels()[LabelTask] != mark.obj.GetLabels()[LabelTask] {
+			r.unmarkOrphaned(mark.res, mark.obj.GetNamespace(), mark.obj.GetName())
+			continue
+		}
+		if r.pruneOrphan(ctx, mark.res, obj, mark.since, now, isDryRunReplica(tasks, obj)) {
+			r.unmarkOrphaned(mark.res, mark.obj.GetNamespace(), mark.obj.GetName())
+		} else {
+			orphans[key] = mark.since
+		}
+	}
+
+	r.orphans = orphans
+
+	return
+}
+
+// Run reconciles periodically until context is done, with tasks currently running
+func (r *Reconciler) Run(ctx context.Context, tasks func() TaskList) {
+	for {
+		if err := r.Reconcile(ctx, tasks()); err != nil && ctx.Err() == nil {
+			r.log.WithError(err).Error("reconcile error")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package replikator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsOrphanedReplica(t *testing.T) {
+	def := TaskDefinition{}
+	def.ID = "test-task"
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = "^team-"
+	def.Prune = true
+	tsk, err := def.Build()
+	require.NoError(t, err)
+
+	tasks := TaskList{tsk}
+
+	ns := &metaV1.ObjectMeta{Name: "team-a"}
+
+	secrets := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+	obj := &unstructured.Unstructured{Object: map[string]any{}}
+	obj.SetNamespace("team-a")
+	obj.SetName("registry-credentials")
+	obj.SetLabels(map[string]string{LabelManaged: "true", LabelTask: "test-task", LabelPrune: "true", LabelSourceNamespace: "default"})
+	obj.SetAnnotations(map[string]string{AnnotationSourceName: "registry-credentials"})
+	require.False(t, isOrphanedReplica(tasks, secrets, obj, ns))
+
+	// source changed
+	obj.SetAnnotations(map[string]string{AnnotationSourceName: "other-credentials"})
+	require.True(t, isOrphanedReplica(tasks, secrets, obj, ns))
+	obj.SetAnnotations(map[string]string{AnnotationSourceName: "registry-credentials"})
+
+	// resource changed
+	require.True(t, isOrphanedReplica(tasks, schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, obj, ns))
+
+	// namespace no longer matches
+	obj.SetNamespace("sandbox")
+	require.True(t, isOrphanedReplica(tasks, secrets, obj, &metaV1.ObjectMeta{Name: "sandbox"}))
+
+	// namespace labels no longer match
+	obj.SetNamespace("team-a")
+	tsk.dstNamespaceSelector = labels.SelectorFromSet(labels.Set{"env": "prod"})
+	ns.Labels = map[string]string{"env": "prod"}
+	require.False(t, isOrphanedReplica(tasks, secrets, obj, ns))
+	ns.Labels = map[string]string{"env": "dev"}
+	require.True(t, isOrphanedReplica(tasks, secrets, obj, ns))
+
+	// prune disabled
+	tsk.prune = false
+	require.False(t, isOrphanedReplica(tasks, secrets, obj, ns))
+
+	// task removed
+	require.True(t, isOrphanedReplica(TaskList{}, secrets, obj, ns))
+}
+
+func TestReconcilerMarkOrphaned(t *testing.T) {
+	secrets := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+	obj := &unstructured.Unstructured{Object: map[string]any{}}
+	obj.SetNamespace("team-a")
+	obj.SetName("registry-credentials")
+	obj.SetUID("1")
+
+	// replicas are never pruned without reconciler
+	var r *Reconciler
+	require.False(t, r.markOrphaned(secrets, obj))
+	r.unmarkOrphaned(secrets, "team-a", "registry-credentials")
+
+	r = NewReconciler(ReconcilerOptions{})
+	require.True(t, r.markOrphaned(secrets, obj))
+	require.False(t, r.markOrphaned(secrets, obj))
+
+	marks := r.copyMarks()
+	require.Len(t, marks, 1)
+	since := marks["/v1, Resource=secrets/team-a/registry-credentials"].since
+	require.False(t, since.IsZero())
+
+	// replica recreated
+	obj = obj.DeepCopy()
+	obj.SetUID("2")
+	require.True(t, r.markOrphaned(secrets, obj))
+	require.Equal(t, "2", string(r.copyMarks()["/v1, Resource=secrets/team-a/registry-credentials"].obj.GetUID()))
+
+	// replicated again
+	r.unmarkOrphaned(secrets, "team-a", "registry-credentials")
+	require.Empty(t, r.copyMarks())
+}
+
+func TestReconcilerDryRunTask(t *testing.T) {
+	replicaLabels := map[string]string{LabelManaged: "true", LabelTask: "reconcile-dry-run", LabelPrune: "true", LabelSourceNamespace: "default"}
+	c := newTestCluster(t, []string{"default", "other"},
+		newTestSecret("other", "registry-credentials", replicaLabels, map[string]string{AnnotationSourceName: "registry-credentials"}),
+	)
+	r := NewReconciler(ReconcilerOptions{Client: c.client, DynamicClient: c.dynClient})
+
+	def := testControllerDefinition("reconcile-dry-run", true)
+	def.DryRun = true
+	task, err := def.Build()
+	require.NoError(t, err)
+
+	// replicas of tasks in dry-run are only logged
+	require.NoError(t, r.Reconcile(context.Background(), TaskList{task}))
+	_, err = c.dynClient.Resource(task.resource).Namespace("other").Get(context.Background(), "registry-credentials", metaV1.GetOptions{})
+	require.NoError(t, err)
+
+	// dry-run turned off
+	task.dryRun = false
+	require.NoError(t, r.Reconcile(context.Background(), TaskList{task}))
+	_, err = c.dynClient.Resource(task.resource).Namespace("other").Get(context.Background(), "registry-credentials", metaV1.GetOptions{})
+	require.True(t, errors.IsNotFound(err))
+}
@@ -0,0 +1,271 @@
+package replikator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yankeguo/rg"
+	"gopkg.in/yaml.v3"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ReplicationResource is the GroupVersionResource of the Replication custom resource
+var ReplicationResource = schema.GroupVersionResource{
+	Group:    "replikator.yankeguo.io",
+	Version:  "v1",
+	Resource: "replications",
+}
+
+// DefaultReplicationResources is the default resources allowed to be replicated by Replication custom resources
+var DefaultReplicationResources = []string{"secrets", "configmaps"}
+
+// TaskDefinitionFromReplication creates a TaskDefinition from the spec of a Replication custom resource,
+// source namespace defaults to, and must be the namespace of the Replication,
+// since any namespace may create one, the resource must be in resources, target.optIn is required,
+// conflictPolicy defaults to, and must not be 'overwrite', and id is prefixed with '<namespace>.'
+func TaskDefinitionFromReplication(obj *unstructured.Unstructured, resources []string) (def TaskDefinition, err error) {
+	defer rg.Guard(&err)
+
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+
+	rg.Must0(yaml.Unmarshal(rg.Must(yaml.Marshal(spec)), &def))
+
+	if def.Source.Namespace == "" {
+		def.Source.Namespace = obj.GetNamespace()
+	}
+	if def.Source.Namespace != obj.GetNamespace() {
+		err = errors.New("source.namespace must be the namespace of the replication")
+		return
+	}
+
+	if !isReplicationResourceAllowed(def.Resource, resources) {
+		err = errors.New("resource is not allowed for replications: " + def.Resource)
+		return
+	}
+
+	if !def.Target.OptIn {
+		err = errors.New("target.optIn is required for replications")
+		return
+	}
+
+	switch ConflictPolicy(def.ConflictPolicy) {
+	case "":
+		def.ConflictPolicy = string(ConflictPolicySkip)
+	case ConflictPolicyOverwrite:
+		err = errors.New("conflictPolicy must not be 'overwrite' for replications")
+		return
+	}
+
+	def.Replication = &types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+
+	// ids are prefixed with the namespace, Replications can not collide with tasks of other namespaces
+	if def.ID != "" {
+		def.ID = obj.GetNamespace() + "." + def.ID
+	} else if id := obj.GetNamespace() + "." + obj.GetName(); len(validation.IsValidLabelValue(id)) == 0 {
+		def.ID = id
+	} else {
+		def.ID = string(obj.GetUID())
+	}
+
+	return
+}
+
+// isReplicationResourceAllowed checks whether the resource is one of resources, by group and resource
+func isReplicationResourceAllowed(resource string, resources []string) bool {
+	res, err := ParseGroupVersionResource(resource)
+	if err != nil {
+		return false
+	}
+	for _, item := range resources {
+		if allowed, err := ParseGroupVersionResource(item); err == nil && allowed.GroupResource() == res.GroupResource() {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadTaskDefinitionsFromCluster loads TaskDefinitions from Replication custom resources in all namespaces,
+// invalid Replications, or Replications of resources not in resources are skipped with warning
+func LoadTaskDefinitionsFromCluster(ctx context.Context, dynClient dynamic.Interface, resources []string) (defs TaskDefinitionList, err error) {
+	defer rg.Guard(&err)
+
+	for _, item := range rg.Must(dynClient.Resource(ReplicationResource).List(ctx, metaV1.ListOptions{})).Items {
+		log := logrus.WithField("replication", item.GetNamespace()+"/"+item.GetName())
+
+		var def TaskDefinition
+		if def, err = TaskDefinitionFromReplication(&item, resources); err == nil {
+			_, err = def.Build()
+		}
+		if err != nil {
+			log.WithError(err).Warn("invalid replication skipped")
+			err = nil
+			continue
+		}
+
+		defs = append(defs, def)
+	}
+
+	return
+}
+
+// replicationSessions tracks sessions of Replication custom resources, running in the controller
+type replicationSessions struct {
+	ctx        context.Context
+	controller *Controller
+	opts       TaskOptions
+	resources  []string
+	log        *logrus.Entry
+
+	// versions are uid and generation of Replications, status updates do not change generation
+	versions map[types.NamespacedName]string
+	sessions map[types.NamespacedName]*Session
+}
+
+// update adds, replaces or removes the session of the Replication, sessions of other Replications are not affected,
+// an invalid Replication keeps its previous session, and the error is written to .status.specError
+func (r *replicationSessions) update(obj *unstructured.Unstructured, deleted bool) {
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	version := string(obj.GetUID()) + "/" + strconv.FormatInt(obj.GetGeneration(), 10)
+
+	if !deleted && r.versions[key] == version {
+		return
+	}
+
+	log := r.log.WithField("replication", key.String())
+
+	MetricConfigReloads.Inc()
+
+	if deleted {
+		if session := r.sessions[key]; session != nil {
+			r.controller.Remove(session)
+			delete(r.sessions, key)
+		}
+		delete(r.versions, key)
+
+		log.Info("replication deleted")
+		return
+	}
+
+	r.versions[key] = version
+
+	previous := r.sessions[key]
+
+	var (
+		def  TaskDefinition
+		task *Task
+		err  error
+	)
+	if def, err = TaskDefinitionFromReplication(obj, r.resources); err == nil {
+		task, err = def.Build()
+	}
+	if err == nil {
+		for _, item := range r.controller.Tasks() {
+			if item.id == task.id && (previous == nil || item != previous.task) {
+				err = errors.New("duplicate task id: " + task.id)
+				break
+			}
+		}
+	}
+	if err != nil {
+		if previous != nil {
+			log.WithError(err).Warn("invalid replication, previous session kept")
+		} else {
+			log.WithError(err).Warn("invalid replication skipped")
+		}
+		r.writeSpecError(key, err)
+		return
+	}
+
+	if previous != nil {
+		r.controller.Remove(previous)
+		delete(r.sessions, key)
+	}
+
+	if _, found, _ := unstructured.NestedString(obj.Object, "status", "specError"); found {
+		r.writeSpecError(key, nil)
+	}
+
+	session := task.NewSession(r.opts)
+	if err = r.controller.Add(session); err != nil {
+		log.WithError(err).Warn("invalid replication skipped")
+		r.writeSpecError(key, err)
+		return
+	}
+	r.sessions[key] = session
+
+	log.Info("replication loaded")
+}
+
+// writeSpecError writes the error of an invalid spec to .status.specError of the Replication, nil to clear
+func (r *replicationSessions) writeSpecError(key types.NamespacedName, specErr error) {
+	if r.opts.DynamicClient == nil || r.opts.DryRun {
+		return
+	}
+
+	var value any
+	if specErr != nil {
+		value = specErr.Error()
+	}
+	buf, err := json.Marshal(map[string]any{"status": map[string]any{"specError": value}})
+	if err == nil {
+		_, err = r.opts.DynamicClient.Resource(ReplicationResource).Namespace(key.Namespace).Patch(r.ctx, key.Name, types.MergePatchType, buf, metaV1.PatchOptions{
+			FieldManager: FieldManagerReplikator,
+		}, "status")
+	}
+	if err != nil && r.ctx.Err() == nil {
+		r.log.WithField("replication", key.String()).WithError(err).Error("failed to write status")
+	}
+}
+
+// WatchReplications starts watching Replication custom resources, and runs their sessions in the controller until context is done,
+// sessions are added, replaced or removed as Replications are created, changed or deleted, other sessions are not affected,
+// only resources are allowed to be replicated, returns a function checking whether existing Replications are loaded
+func WatchReplications(ctx context.Context, c *Controller, opts TaskOptions, resources []string) cache.InformerSynced {
+	r := &replicationSessions{
+		ctx:        ctx,
+		controller: c,
+		opts:       opts,
+		resources:  resources,
+		log:        logrus.WithField("component", "replications"),
+		versions:   map[types.NamespacedName]string{},
+		sessions:   map[types.NamespacedName]*Session{},
+	}
+
+	informer := dynamicinformer.NewFilteredDynamicInformer(opts.DynamicClient, ReplicationResource, metaV1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+
+	// handlers are called sequentially
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			if item, ok := obj.(*unstructured.Unstructured); ok {
+				r.update(item, false)
+			}
+		},
+		UpdateFunc: func(_, obj any) {
+			if item, ok := obj.(*unstructured.Unstructured); ok {
+				r.update(item, false)
+			}
+		},
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if item, ok := obj.(*unstructured.Unstructured); ok {
+				r.update(item, true)
+			}
+		},
+	})
+
+	go informer.Run(ctx.Done())
+
+	return informer.HasSynced
+}
@@ -0,0 +1,235 @@
+package replikator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+)
+
+func newTestReplication(namespace, name string, spec map[string]any) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "replikator.yankeguo.io/v1",
+		"kind":       "Replication",
+		"spec":       spec,
+	}}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetUID("5e0b3a0c-7f1e-4c2a-9a57-2c4c2a4e2f10")
+	obj.SetGeneration(1)
+	return obj
+}
+
+func TestTaskDefinitionFromReplication(t *testing.T) {
+	def, err := TaskDefinitionFromReplication(newTestReplication("auto-ops", "registry", map[string]any{
+		"resource": "secrets",
+		"source": map[string]any{
+			"name": "registry-credentials",
+		},
+		"target": map[string]any{
+			"namespace":         ".+",
+			"excludeNamespaces": []any{"^kube-"},
+			"optIn":             true,
+		},
+		"modification": map[string]any{
+			"jsonpatch": []any{
+				map[string]any{"op": "remove", "path": "/status"},
+			},
+		},
+		"prune": true,
+	}), DefaultReplicationResources)
+	require.NoError(t, err)
+	require.Equal(t, "auto-ops.registry", def.ID)
+	require.Equal(t, &types.NamespacedName{Namespace: "auto-ops", Name: "registry"}, def.Replication)
+	require.Equal(t, "secrets", def.Resource)
+	require.Equal(t, "auto-ops", def.Source.Namespace)
+	require.Equal(t, "registry-credentials", def.Source.Name)
+	require.Equal(t, ".+", def.Target.Namespace)
+	require.Equal(t, []string{"^kube-"}, def.Target.ExcludeNamespaces)
+	require.Len(t, def.Modification.JSONPatch, 1)
+	require.True(t, def.Prune)
+	require.Equal(t, string(ConflictPolicySkip), def.ConflictPolicy)
+
+	_, err = def.Build()
+	require.NoError(t, err)
+
+	_, err = TaskDefinitionFromReplication(newTestReplication("auto-ops", "registry", map[string]any{
+		"resource": "secrets",
+		"source": map[string]any{
+			"namespace": "kube-system",
+			"name":      "registry-credentials",
+		},
+		"target": map[string]any{
+			"namespace": ".+",
+			"optIn":     true,
+		},
+	}), DefaultReplicationResources)
+	require.Error(t, err)
+
+	for _, spec := range []map[string]any{
+		// resource not allowed
+		{
+			"resource": "rbac.authorization.k8s.io/v1/rolebindings",
+			"source":   map[string]any{"name": "admin"},
+			"target":   map[string]any{"optIn": true},
+		},
+		// target.optIn required
+		{
+			"resource": "secrets",
+			"source":   map[string]any{"name": "registry-credentials"},
+			"target":   map[string]any{"namespace": ".+"},
+		},
+		// conflictPolicy 'overwrite' forbidden
+		{
+			"resource":       "secrets",
+			"source":         map[string]any{"name": "registry-credentials"},
+			"target":         map[string]any{"optIn": true},
+			"conflictPolicy": "overwrite",
+		},
+	} {
+		_, err = TaskDefinitionFromReplication(newTestReplication("auto-ops", "registry", spec), DefaultReplicationResources)
+		require.Error(t, err)
+	}
+
+	def, err = TaskDefinitionFromReplication(newTestReplication("auto-ops", "registry", map[string]any{
+		"resource":       "v1/secrets",
+		"source":         map[string]any{"name": "registry-credentials"},
+		"target":         map[string]any{"optIn": true},
+		"conflictPolicy": "adopt-if-annotated",
+	}), []string{"configmaps", "secrets"})
+	require.NoError(t, err)
+	require.Equal(t, string(ConflictPolicyAdoptIfAnnotated), def.ConflictPolicy)
+
+	def, err = TaskDefinitionFromReplication(newTestReplication("auto-ops", "registry", map[string]any{
+		"id":       "registry",
+		"resource": "secrets",
+		"source":   map[string]any{"name": "registry-credentials"},
+		"target":   map[string]any{"optIn": true},
+	}), DefaultReplicationResources)
+	require.NoError(t, err)
+	require.Equal(t, "auto-ops.registry", def.ID)
+}
+
+func TestLoadTaskDefinitionsFromCluster(t *testing.T) {
+	client := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		ReplicationResource: "ReplicationList",
+	},
+		newTestReplication("auto-ops", "valid", map[string]any{
+			"resource": "secrets",
+			"source":   map[string]any{"name": "registry-credentials"},
+			"target":   map[string]any{"namespace": ".+", "optIn": true},
+		}),
+		newTestReplication("auto-ops", "invalid", map[string]any{
+			"resource": "secrets",
+			"source":   map[string]any{"name": "registry-credentials"},
+		}),
+	)
+
+	defs, err := LoadTaskDefinitionsFromCluster(context.Background(), client, DefaultReplicationResources)
+	require.NoError(t, err)
+	require.Len(t, defs, 1)
+	require.Equal(t, "auto-ops.valid", defs[0].ID)
+}
+
+func TestReplicationSessionsUpdate(t *testing.T) {
+	c := NewController(RunOptions{})
+	t.Cleanup(c.queue.ShutDown)
+
+	spec := map[string]any{
+		"resource": "secrets",
+		"source":   map[string]any{"name": "registry-credentials"},
+		"target":   map[string]any{"namespace": ".+", "optIn": true},
+	}
+
+	obj := newTestReplication("auto-ops", "registry", spec)
+	other := newTestReplication("auto-ops", "other", spec)
+	other.SetUID("7d6f1c2e-0a3b-4f5c-8e9d-1b2c3d4e5f60")
+
+	client := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		ReplicationResource: "ReplicationList",
+	}, obj.DeepCopy(), other.DeepCopy())
+
+	specError := func() any {
+		item, err := client.Resource(ReplicationResource).Namespace("auto-ops").Get(context.Background(), "registry", metaV1.GetOptions{})
+		require.NoError(t, err)
+		value, _, _ := unstructured.NestedFieldNoCopy(item.Object, "status", "specError")
+		return value
+	}
+
+	r := &replicationSessions{
+		ctx:        context.Background(),
+		controller: c,
+		opts:       TaskOptions{DynamicClient: client},
+		resources:  DefaultReplicationResources,
+		log:        logrus.WithField("component", "replications"),
+		versions:   map[types.NamespacedName]string{},
+		sessions:   map[types.NamespacedName]*Session{},
+	}
+
+	// added
+	r.update(obj, false)
+	sessions := c.Sessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, "auto-ops.registry", sessions[0].task.id)
+
+	// other Replications are not affected
+	r.update(other, false)
+	require.Len(t, c.Sessions(), 2)
+	require.Contains(t, c.Sessions(), sessions[0])
+
+	// generation not changed, e.g. status updated
+	r.update(obj, false)
+	require.Contains(t, c.Sessions(), sessions[0])
+
+	// generation changed
+	obj.SetGeneration(2)
+	r.update(obj, false)
+	require.Len(t, c.Sessions(), 2)
+	require.NotContains(t, c.Sessions(), sessions[0])
+	session := r.sessions[types.NamespacedName{Namespace: "auto-ops", Name: "registry"}]
+	require.NotNil(t, session)
+	require.Nil(t, specError())
+
+	// invalid, previous session kept
+	invalid := newTestReplication("auto-ops", "registry", map[string]any{"resource": "secrets"})
+	invalid.SetGeneration(3)
+	r.update(invalid, false)
+	require.Len(t, c.Sessions(), 2)
+	require.Contains(t, c.Sessions(), session)
+	require.NotEmpty(t, specError())
+
+	// duplicate task id, previous session kept
+	duplicate := newTestReplication("auto-ops", "registry", map[string]any{
+		"id":       "other",
+		"resource": "secrets",
+		"source":   map[string]any{"name": "registry-credentials"},
+		"target":   map[string]any{"optIn": true},
+	})
+	duplicate.SetGeneration(4)
+	r.update(duplicate, false)
+	require.Len(t, c.Sessions(), 2)
+	require.Contains(t, c.Sessions(), session)
+	require.Contains(t, specError(), "duplicate task id")
+
+	// fixed, error cleared
+	fixed := newTestReplication("auto-ops", "registry", spec)
+	fixed.SetGeneration(5)
+	require.NoError(t, unstructured.SetNestedField(fixed.Object, "invalid", "status", "specError"))
+	r.update(fixed, false)
+	require.Len(t, c.Sessions(), 2)
+	require.NotContains(t, c.Sessions(), session)
+	require.Nil(t, specError())
+
+	// deleted
+	r.update(other, true)
+	r.update(fixed, true)
+	require.Empty(t, c.Sessions())
+	require.Empty(t, r.sessions)
+}
@@ -0,0 +1,57 @@
+package replikator
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryLimit is how many times a failed namespace is retried with backoff, before giving up,
+// namespaces given up are still synchronized on source changes and full synchronizations, which start retries over
+const RetryLimit = 10
+
+// retryBackoff returns the delay before the n-th retry, doubled from base up to max
+func retryBackoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// retryTracker tracks consecutive failures of namespaces, for retries with backoff
+type retryTracker struct {
+	lock     sync.Mutex
+	attempts map[string]int
+}
+
+// failed records a failure of the namespace, returns number of consecutive failures,
+// retries are given up if it exceeds RetryLimit
+func (t *retryTracker) failed(namespace string) (attempts int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.attempts == nil {
+		t.attempts = map[string]int{}
+	}
+	t.attempts[namespace]++
+	return t.attempts[namespace]
+}
+
+// succeeded clears failures of the namespace
+func (t *retryTracker) succeeded(namespace string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.attempts, namespace)
+}
+
+// reset clears failures of all namespaces, on new triggers, so giving up applies to a single streak of failures
+func (t *retryTracker) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.attempts = nil
+}
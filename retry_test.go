@@ -0,0 +1,58 @@
+package replikator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	listersCoreV1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	require.Equal(t, time.Second, retryBackoff(1, time.Second, time.Minute))
+	require.Equal(t, 2*time.Second, retryBackoff(2, time.Second, time.Minute))
+	require.Equal(t, 32*time.Second, retryBackoff(6, time.Second, time.Minute))
+	require.Equal(t, time.Minute, retryBackoff(7, time.Second, time.Minute))
+	require.Equal(t, time.Minute, retryBackoff(1000, time.Second, time.Minute))
+}
+
+func TestRetryTracker(t *testing.T) {
+	tracker := &retryTracker{}
+
+	require.Equal(t, 1, tracker.failed("team-a"))
+	require.Equal(t, 2, tracker.failed("team-a"))
+	require.Equal(t, 1, tracker.failed("team-b"))
+
+	tracker.succeeded("team-a")
+	require.Equal(t, 1, tracker.failed("team-a"))
+
+	tracker.reset()
+	require.Equal(t, 1, tracker.failed("team-a"))
+	require.Equal(t, 1, tracker.failed("team-b"))
+}
+
+func TestSessionDoNamespaceDeleted(t *testing.T) {
+	tasks, err := TaskDefinitionList{testControllerDefinition("task-a", false)}.Build()
+	require.NoError(t, err)
+
+	s := tasks[0].NewSession(TaskOptions{})
+	s.namespaceLister = listersCoreV1.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+
+	src := &unstructured.Unstructured{Object: map[string]any{}}
+	src.SetName("registry-credentials")
+	s.status.setTarget("team-a", "registry-credentials", src, errors.New("quota exceeded"))
+	s.status.setTarget("team-b", "registry-credentials", src, nil)
+	s.retries.failed("team-a")
+
+	// retries and status of the namespace are cleared
+	retries, err := s.Do(context.Background(), "team-a")
+	require.NoError(t, err)
+	require.Empty(t, retries)
+	require.Equal(t, 1, s.retries.failed("team-a"))
+	require.Len(t, s.status.targets, 1)
+	require.Contains(t, s.status.targets, "team-b/registry-credentials")
+}
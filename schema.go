@@ -0,0 +1,235 @@
+package replikator
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//go:generate sh -c "go run ./cmd/replikator schema > deploy/task-definition.schema.json"
+
+// schemaAnnotation annotates a field in JSON Schema, which can not be reflected from the type
+type schemaAnnotation struct {
+	description string
+	required    bool
+	enum        []string
+	// extra is merged into the generated schema
+	extra map[string]any
+}
+
+// schemaAnnotations annotates fields, keyed by '<type name>.<yaml path>', fields of anonymous structs are nested in the path
+var schemaAnnotations = map[string]schemaAnnotation{
+	"TaskDefinition.id": {
+		description: "task id, default to a digest of resource, source and target name, must be unique and a valid label value, required for tasks of the same resource, source and target name",
+	},
+	"TaskDefinition.resource": {
+		description: "resource name, should be canonical plural, e.g. 'secrets', 'networking.k8s.io/v1/ingresses', 'apps/v1/deployments'",
+		required:    true,
+	},
+	"TaskDefinition.source": {
+		description: "replication source",
+		required:    true,
+	},
+	"TaskDefinition.source.namespace": {
+		description: "source namespace",
+		required:    true,
+	},
+	"TaskDefinition.source.name": {
+		description: "source resource name, required if selector is not set",
+	},
+	"TaskDefinition.source.selector": {
+		description: "source resource label selector, replicates every matching resource, mutually exclusive with name",
+	},
+	"TaskDefinition.target": {
+		description: "replication target",
+		required:    true,
+	},
+	"TaskDefinition.target.namespace": {
+		description: "target namespace regexp, optional if namespaceSelector or optIn is set",
+	},
+	"TaskDefinition.target.namespaceSelector": {
+		description: "target namespace label selector, optional if namespace or optIn is set",
+	},
+	"TaskDefinition.target.name": {
+		description: "target resource name, default to source name, go template with '.Source' and '.Namespace', must be a template with source.selector",
+	},
+	"TaskDefinition.target.excludeNamespaces": {
+		description: "target namespace regexps to exclude",
+	},
+	"TaskDefinition.target.excludeNamespaceSelector": {
+		description: "target namespace label selector to exclude",
+	},
+	"TaskDefinition.target.optIn": {
+		description: "only replicate to namespaces opted-in with annotation 'replikator.yankeguo.io/want'",
+	},
+	"TaskDefinition.modification": {
+		description: "modification of the resource",
+	},
+	"TaskDefinition.modification.jsonpatch": {
+		description: "jsonpatch operations to modify the resource",
+		extra:       map[string]any{"items": jsonPatchOperationSchema()},
+	},
+	"TaskDefinition.modification.javascript": {
+		description: "javascript code to modify the 'resource' object in place, ES5 only",
+	},
+	"TaskDefinition.prune": {
+		description: "delete replicas when the source resource is deleted or stops matching, or when they no longer belong to the task",
+	},
+	"TaskDefinition.conflictPolicy": {
+		description: "what to do if the target resource exists and is not created by this task, default to 'overwrite'",
+		enum: []string{
+			string(ConflictPolicyOverwrite),
+			string(ConflictPolicySkip),
+			string(ConflictPolicyAdoptIfAnnotated),
+		},
+	},
+	"TaskDefinition.dryRun": {
+		description: "only log planned changes of this task, nothing is persisted",
+	},
+	"TaskDefinition.resyncPeriod": {
+		description: "period of full synchronizations of this task, e.g. '10m', '0' to disable, default to --resync-period",
+		extra:       map[string]any{"pattern": `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`},
+	},
+	"LabelSelectorDefinition.matchLabels": {
+		description: "labels to match exactly",
+	},
+	"LabelSelectorDefinition.matchExpressions": {
+		description: "label selector requirements",
+	},
+	"LabelSelectorRequirementDefinition.key": {
+		description: "label key",
+		required:    true,
+	},
+	"LabelSelectorRequirementDefinition.operator": {
+		description: "operator of the requirement",
+		required:    true,
+		enum:        []string{"In", "NotIn", "Exists", "DoesNotExist"},
+	},
+	"LabelSelectorRequirementDefinition.values": {
+		description: "label values, must be empty for 'Exists' and 'DoesNotExist'",
+	},
+}
+
+// jsonPatchOperationSchema returns JSON Schema of a jsonpatch operation
+func jsonPatchOperationSchema() map[string]any {
+	var ops []string
+	for op := range jsonPatchOperations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"op":    map[string]any{"type": "string", "enum": ops, "description": "operation"},
+			"path":  map[string]any{"type": "string", "description": "JSON pointer of the target location"},
+			"from":  map[string]any{"type": "string", "description": "JSON pointer of the source location, for 'move' and 'copy'"},
+			"value": map[string]any{"description": "value to add, replace or test"},
+		},
+		"required": []string{"op", "path"},
+	}
+}
+
+// schemaGenerator generates JSON Schema from types, by reflecting over yaml tags
+type schemaGenerator struct {
+	// annotated records keys of schemaAnnotations used
+	annotated map[string]bool
+}
+
+func (g *schemaGenerator) typeSchema(t reflect.Type, path string) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.typeSchema(t.Elem(), path)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.typeSchema(t.Elem(), path)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.typeSchema(t.Elem(), path)}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		// annotations of named structs are keyed by the type name
+		if t.Name() != "" {
+			path = t.Name()
+		}
+		return g.structSchema(t, path)
+	default:
+		panic("unsupported type in JSON Schema: " + t.String())
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type, path string) map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		key := path + "." + name
+		schema := g.typeSchema(field.Type, key)
+
+		if annotation, ok := schemaAnnotations[key]; ok {
+			g.annotated[key] = true
+			if annotation.description != "" {
+				schema["description"] = annotation.description
+			}
+			if len(annotation.enum) > 0 {
+				schema["enum"] = annotation.enum
+			}
+			for k, v := range annotation.extra {
+				schema[k] = v
+			}
+			if annotation.required {
+				required = append(required, name)
+			}
+		}
+
+		properties[name] = schema
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// generateTaskDefinitionSchema generates JSON Schema of TaskDefinition, returns keys of schemaAnnotations used
+func generateTaskDefinitionSchema() (schema map[string]any, annotated map[string]bool) {
+	g := &schemaGenerator{annotated: map[string]bool{}}
+	schema = g.typeSchema(reflect.TypeOf(TaskDefinition{}), "")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "replikator task definition"
+	annotated = g.annotated
+	return
+}
+
+// TaskDefinitionSchema returns JSON Schema of TaskDefinition, generated from the struct
+func TaskDefinitionSchema() map[string]any {
+	schema, _ := generateTaskDefinitionSchema()
+	return schema
+}
+
+// TaskDefinitionSchemaJSON returns JSON Schema of TaskDefinition, as indented JSON
+func TaskDefinitionSchemaJSON() (buf []byte, err error) {
+	if buf, err = json.MarshalIndent(TaskDefinitionSchema(), "", "  "); err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+	return
+}
@@ -0,0 +1,49 @@
+package replikator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskDefinitionSchemaJSON(t *testing.T) {
+	buf, err := TaskDefinitionSchemaJSON()
+	require.NoError(t, err)
+
+	file, err := os.ReadFile(filepath.Join("deploy", "task-definition.schema.json"))
+	require.NoError(t, err)
+	require.Equal(t, string(file), string(buf), "schema is out of date, run 'go generate'")
+}
+
+// requireSchemaDescribed requires every property in schema to have a description
+func requireSchemaDescribed(t *testing.T, path string, schema map[string]any) {
+	if items, ok := schema["items"].(map[string]any); ok {
+		requireSchemaDescribed(t, path+"[]", items)
+	}
+	properties, _ := schema["properties"].(map[string]any)
+	for name, property := range properties {
+		property := property.(map[string]any)
+		require.NotEmpty(t, property["description"], "missing description of %s.%s", path, name)
+		requireSchemaDescribed(t, path+"."+name, property)
+	}
+}
+
+func TestTaskDefinitionSchema(t *testing.T) {
+	schema, annotated := generateTaskDefinitionSchema()
+
+	for key := range schemaAnnotations {
+		require.True(t, annotated[key], "unused schema annotation: %s", key)
+	}
+
+	require.Equal(t, []string{"resource", "source", "target"}, schema["required"])
+
+	properties := schema["properties"].(map[string]any)
+	require.NotContains(t, properties, "Replication")
+
+	source := properties["source"].(map[string]any)
+	require.Equal(t, []string{"namespace"}, source["required"])
+
+	requireSchemaDescribed(t, "", map[string]any{"properties": properties})
+}
@@ -8,79 +8,234 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/yankeguo/rg"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	listerCoreV1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const FieldManagerReplikator = "io.github.yankeguo/replikator"
 
 type SessionList []*Session
 
-func (list SessionList) Run(ctx context.Context) {
-	wg := &sync.WaitGroup{}
-	for _, _session := range list {
-		session := _session
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			session.Run(ctx)
-		}()
-	}
-	wg.Wait()
-}
-
 type Session struct {
 	task      *Task
-	client    *kubernetes.Clientset
-	dynClient *dynamic.DynamicClient
+	client    kubernetes.Interface
+	dynClient dynamic.Interface
 	log       *logrus.Entry
 	versions  map[string]string
+
+	status          taskStatusTracker
+	statusConfigMap types.NamespacedName
+	recorder        record.EventRecorder
+	health          sessionHealth
+	replicas        replicaTracker
+	retries         retryTracker
+
+	// listers of shared informers, set by the controller, resources are retrieved from the cluster if not set,
+	// sourceLister only lists resources in the source namespace
+	namespaceLister listerCoreV1.NamespaceLister
+	sourceLister    cache.GenericLister
+
+	// syncLock serializes synchronizations of the session
+	syncLock sync.Mutex
+
+	// reconciler deletes replicas marked orphaned after grace period, replicas are never pruned if not set
+	reconciler *Reconciler
+
+	// resyncPeriod is the period of full synchronizations, 0 if disabled
+	resyncPeriod time.Duration
+
+	// dryRun only logs planned changes, nothing is persisted
+	dryRun bool
 }
 
-func (s *Session) listDestinationNamespaces(ctx context.Context) (namespaces []string, err error) {
+func (s *Session) listDestinationNamespaces(ctx context.Context) (namespaces []*coreV1.Namespace, err error) {
 	defer rg.Guard(&err)
 
+	if s.namespaceLister != nil {
+		for _, namespace := range rg.Must(s.namespaceLister.List(labels.Everything())) {
+			if s.task.matchNamespace(namespace) {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+		return
+	}
+
 	for _, namespace := range rg.Must(s.client.CoreV1().Namespaces().List(ctx, metaV1.ListOptions{})).Items {
-		// skip source namespace
-		if namespace.Name == s.task.srcNamespace {
-			continue
+		if s.task.matchNamespace(&namespace) {
+			namespaces = append(namespaces, &namespace)
+		}
+	}
+	return
+}
+
+// getNamespace retrieves the namespace from the shared informer, or the cluster
+func (s *Session) getNamespace(ctx context.Context, name string) (*coreV1.Namespace, error) {
+	if s.namespaceLister != nil {
+		return s.namespaceLister.Get(name)
+	}
+	return s.client.CoreV1().Namespaces().Get(ctx, name, metaV1.GetOptions{})
+}
+
+// stripResource removes status and server populated metadata from the source resource, except uid and resourceVersion
+func stripResource(src *unstructured.Unstructured) {
+	delete(src.Object, "status")
+	if metadata, ok := src.Object["metadata"].(map[string]interface{}); ok {
+		src.Object["metadata"] = map[string]interface{}{
+			"name":            metadata["name"],
+			"namespace":       metadata["namespace"],
+			"labels":          metadata["labels"],
+			"annotations":     metadata["annotations"],
+			"uid":             metadata["uid"],
+			"resourceVersion": metadata["resourceVersion"],
+		}
+	}
+}
+
+// fetchResourcesFromCache retrieves source resources from the shared informer
+func (s *Session) fetchResourcesFromCache() (sources []*unstructured.Unstructured, err error) {
+	lister := s.sourceLister.ByNamespace(s.task.srcNamespace)
+
+	var items []runtime.Object
+	if s.task.srcSelector != nil {
+		if items, err = lister.List(s.task.srcSelector); err != nil {
+			return
+		}
+	} else {
+		var item runtime.Object
+		if item, err = lister.Get(s.task.srcName); err != nil {
+			return
+		}
+		items = append(items, item)
+	}
+
+	// objects in cache must not be modified
+	for _, item := range items {
+		sources = append(sources, item.(*unstructured.Unstructured).DeepCopy())
+	}
+	return
+}
+
+func (s *Session) fetchResources(ctx context.Context) (sources []*unstructured.Unstructured, err error) {
+	defer rg.Guard(&err)
+
+	client := s.dynClient.Resource(s.task.resource).Namespace(s.task.srcNamespace)
+
+	if s.sourceLister != nil {
+		if sources, err = s.fetchResourcesFromCache(); err != nil {
+			return
 		}
-		if s.task.dstNamespace.MatchString(namespace.Name) {
-			namespaces = append(namespaces, namespace.Name)
+	} else if s.task.srcSelector != nil {
+		for _, item := range rg.Must(client.List(ctx, metaV1.ListOptions{LabelSelector: s.task.srcSelector.String()})).Items {
+			sources = append(sources, &item)
 		}
+	} else {
+		var src *unstructured.Unstructured
+		if src, err = client.Get(ctx, s.task.srcName, metaV1.GetOptions{}); err != nil {
+			return
+		}
+		sources = append(sources, src)
 	}
+
+	for _, src := range sources {
+		stripResource(src)
+	}
+
 	return
 }
 
-func (s *Session) fetchResource(ctx context.Context) (src *unstructured.Unstructured, rv string, err error) {
+// prune marks replicas of the task in the namespace (all namespaces if empty), whose source is not one of sources,
+// as orphaned, they are deleted by the Reconciler after grace period, unless replicated again
+func (s *Session) prune(ctx context.Context, namespace string, sources []*unstructured.Unstructured) (err error) {
 	defer rg.Guard(&err)
 
-	src = rg.Must(s.dynClient.Resource(s.task.resource).Namespace(s.task.srcNamespace).Get(ctx, s.task.srcName, metaV1.GetOptions{}))
+	names := map[string]struct{}{}
+	for _, src := range sources {
+		names[src.GetName()] = struct{}{}
+	}
 
-	rv = src.GetResourceVersion()
+	client := s.dynClient.Resource(s.task.resource)
+
+	items := rg.Must(client.Namespace(namespace).List(ctx, metaV1.ListOptions{
+		LabelSelector: LabelManaged + "=true," + LabelTask + "=" + s.task.id,
+	})).Items
+
+	// replicas created before ownership marking are only recognized by field manager,
+	// they were always replicated from a single named source, to a fixed name
+	if len(sources) == 0 && s.task.srcSelector == nil && s.task.dstNameTemplate == nil {
+		name, _ := s.task.targetName(&metaV1.ObjectMeta{Name: s.task.srcName, Namespace: s.task.srcNamespace}, nil)
+		for _, item := range rg.Must(client.Namespace(namespace).List(ctx, metaV1.ListOptions{
+			FieldSelector: "metadata.name=" + name,
+		})).Items {
+			if item.GetNamespace() != s.task.srcNamespace && item.GetLabels()[LabelManaged] != "true" && isReplicatedResource(&item) {
+				items = append(items, item)
+			}
+		}
+	}
 
-	delete(src.Object, "status")
-	if metadata, ok := src.Object["metadata"].(map[string]interface{}); ok {
-		src.Object["metadata"] = map[string]interface{}{
-			"name":        metadata["name"],
-			"namespace":   metadata["namespace"],
-			"labels":      metadata["labels"],
-			"annotations": metadata["annotations"],
+	for _, item := range items {
+		if _, ok := names[item.GetAnnotations()[AnnotationSourceName]]; ok {
+			continue
+		}
+
+		key := item.GetNamespace() + "/" + item.GetName()
+
+		log := s.log.WithField("dst", key)
+
+		if s.dryRun {
+			log.Info("dry-run: would prune after grace period")
+			continue
+		}
+
+		if s.reconciler.markOrphaned(s.task.resource, &item) {
+			log.Info("replica orphaned, pruning after grace period")
+		}
+
+		delete(s.versions, key)
+		s.replicas.forget(key)
+		s.status.removeTarget(item.GetNamespace(), item.GetName())
+	}
+
+	return
+}
+
+// checkConflict checks whether the existing resource in the namespace can be written, according to the conflict policy
+func (s *Session) checkConflict(ctx context.Context, namespace string, name string) (existing *unstructured.Unstructured, ok bool, err error) {
+	if s.task.conflictPolicy == ConflictPolicyOverwrite {
+		ok = true
+		return
+	}
+
+	if existing, err = s.dynClient.Resource(s.task.resource).Namespace(namespace).Get(ctx, name, metaV1.GetOptions{}); err != nil {
+		existing = nil
+		if errors.IsNotFound(err) {
+			err = nil
+			ok = true
 		}
+		return
 	}
 
+	ok = s.task.canOverwrite(existing)
 	return
 }
 
-func (s *Session) createReplicatedResource(source *unstructured.Unstructured, namespace string) (obj *unstructured.Unstructured, err error) {
+func (s *Session) createReplicatedResource(source *unstructured.Unstructured, namespace string, name string) (obj *unstructured.Unstructured, err error) {
 	defer rg.Guard(&err)
 
 	obj = source.DeepCopy()
 	obj.SetNamespace(namespace)
-	obj.SetName(s.task.dstName)
+	obj.SetName(name)
+	obj.SetUID("")
+	obj.SetResourceVersion("")
 
 	// apply jsonpatch
 	if s.task.jsonpatch != nil {
@@ -93,170 +248,238 @@ func (s *Session) createReplicatedResource(source *unstructured.Unstructured, na
 	// apply javascript
 	if s.task.javascript != "" {
 		buf := rg.Must(obj.MarshalJSON())
-		out := rg.Must(EvaluateJavaScriptModification(string(buf), s.task.javascript))
+		start := time.Now()
+		out, err := EvaluateJavaScriptModification(string(buf), s.task.javascript)
+		metricJavaScriptDuration.WithLabelValues(s.task.id).Observe(time.Since(start).Seconds())
+		if err == ErrScriptTimeout {
+			metricJavaScriptTimeouts.WithLabelValues(s.task.id).Inc()
+		}
+		rg.Must0(err)
 		obj = &unstructured.Unstructured{}
 		rg.Must0(obj.UnmarshalJSON([]byte(out)))
 	}
 
+	// mark ownership
+	s.task.markReplica(obj, source)
+
 	return
 }
 
-func (s *Session) Do(ctx context.Context, namespace string) (err error) {
+// logDryRun logs the difference between the live replica and the result of a dry-run apply
+func (s *Session) logDryRun(ctx context.Context, log *logrus.Entry, replica *unstructured.Unstructured) {
+	diff, created, err := s.diffReplica(ctx, replica)
+	if err != nil {
+		log.WithError(err).Error("dry-run failed to diff replica")
+		return
+	}
+
+	if created {
+		log.WithField("diff", diff).Info("dry-run: would create")
+	} else if diff == "" {
+		log.Info("dry-run: unchanged")
+	} else {
+		log.WithField("diff", diff).Info("dry-run: would update")
+	}
+}
+
+// Do synchronizes the task in the namespace, or all namespaces if empty,
+// returns namespaces failed to replicate to, with consecutive failures, namespaces given up are excluded
+func (s *Session) Do(ctx context.Context, namespace string) (retries map[string]int, err error) {
 	defer rg.Guard(&err)
 
-	var namespaces []string
+	var namespaces []*coreV1.Namespace
 
 	if namespace == "" {
 		namespaces = rg.Must(s.listDestinationNamespaces(ctx))
 	} else {
-		namespaces = []string{namespace}
+		var ns *coreV1.Namespace
+		if ns, err = s.getNamespace(ctx, namespace); err != nil {
+			// namespace deleted, e.g. while retries pending
+			if errors.IsNotFound(err) {
+				err = nil
+				s.retries.succeeded(namespace)
+				s.status.removeNamespace(namespace)
+			}
+			return
+		}
+		if !s.task.matchNamespace(ns) {
+			s.retries.succeeded(namespace)
+			// prune replicas if namespace stops matching, e.g. opted-out or labels changed
+			if s.task.prune {
+				err = s.prune(ctx, namespace, nil)
+			}
+			return
+		}
+		namespaces = []*coreV1.Namespace{ns}
 	}
 
-	src, rv := rg.Must2(s.fetchResource(ctx))
-
-	for _, namespace := range namespaces {
-		if s.versions[namespace] == rv {
-			continue
+	sources, err := s.fetchResources(ctx)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			s.status.setSources(nil)
 		}
+		if errors.IsNotFound(err) && s.task.prune {
+			s.log.Info("source not found, pruning replicas")
+			err = s.prune(ctx, namespace, nil)
+		}
+		return
+	}
 
-		log := s.log.WithField("dst", namespace+"/"+s.task.dstName)
+	s.status.setSources(sources)
 
-		obj := rg.Must(s.createReplicatedResource(src, namespace))
+	// namespaces with failures worth retrying, e.g. webhook or quota errors
+	failed := map[string]bool{}
 
-		log.Info("replicating")
+	for _, src := range sources {
+		rv := src.GetResourceVersion()
 
-		if _, err = s.dynClient.Resource(s.task.resource).Namespace(namespace).Apply(ctx, s.task.dstName, obj, metaV1.ApplyOptions{
-			Force:        true,
-			FieldManager: FieldManagerReplikator,
-		}); err != nil {
-			log.WithError(err).Error("replication failed")
-			err = nil
-		} else {
-			s.versions[namespace] = rv
-		}
-	}
+		for _, ns := range namespaces {
+			namespace := ns.Name
 
-	return
-}
+			name, err := s.task.targetName(src, ns)
+			if err != nil {
+				s.log.WithField("dst", namespace).WithError(err).Error("target name rendering failed")
+				continue
+			}
 
-func (s *Session) Watch(ctx context.Context, triggers chan string) {
-	var err error
-	for {
-		if ctx.Err() != nil {
-			return
-		}
+			key := namespace + "/" + name
 
-		if err = s.watch(ctx, triggers); err != nil {
-			if ctx.Err() == nil {
-				s.log.WithError(err).Error("watch error")
+			drifted := s.replicas.takeDrifted(key)
+
+			if !drifted && s.versions[key] == rv {
+				continue
 			}
-		}
 
-		time.Sleep(5 * time.Second)
-	}
-}
+			log := s.log.WithField("dst", key)
 
-func (s *Session) watch(ctx context.Context, triggers chan string) (err error) {
-	defer rg.Guard(&err)
+			if drifted {
+				log.Info("replica drifted, repairing")
+			}
 
-	if ctx.Err() != nil {
-		return
-	}
+			if existing, ok, err := s.checkConflict(ctx, namespace, name); err != nil {
+				log.WithError(err).Error("conflict check failed")
+				s.status.setTarget(namespace, name, src, err)
+				failed[namespace] = true
+				continue
+			} else if !ok {
+				log.WithField("policy", s.task.conflictPolicy).Warn("replication skipped, resource exists and not owned by replikator")
+				err = fmt.Errorf("resource exists and not owned by replikator, conflict policy: %s", s.task.conflictPolicy)
+				s.status.setTarget(namespace, name, src, err)
+				s.event(existing, coreV1.EventTypeWarning, EventReasonConflict, "Replication of %s skipped: %s", s.task.describeSource(), err.Error())
+				s.event(src, coreV1.EventTypeWarning, EventReasonConflict, "Replication to %s skipped: %s", key, err.Error())
+				continue
+			}
 
-	// cancel context when done
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// trigger initial synchronization
-	triggers <- ""
-
-	wg := &sync.WaitGroup{}
-
-	// watch for resource changes
-	watchResource := rg.Must(s.dynClient.Resource(s.task.resource).Namespace(s.task.srcNamespace).Watch(ctx, metaV1.ListOptions{}))
-	defer watchResource.Stop()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for event := range watchResource.ResultChan() {
-			if err = func() (err error) {
-				defer rg.Guard(&err)
-				switch event.Type {
-				case watch.Modified:
-					if name := rg.Must(RetrieveMetadataName(event.Object)); name == s.task.srcName {
-						triggers <- ""
-					}
-				case watch.Error:
-					err = fmt.Errorf("watch error: %+v", event.Object)
-					return
+			// replication metrics only count replicas persisted
+			if !s.dryRun {
+				metricReplicationAttempts.WithLabelValues(s.task.id, namespace).Inc()
+			}
+
+			obj, err := s.createReplicatedResource(src, namespace, name)
+			if err != nil {
+				if !s.dryRun {
+					metricReplicationFailures.WithLabelValues(s.task.id, namespace).Inc()
 				}
-				return
-			}(); err != nil {
-				cancel()
-				return
+				log.WithError(err).Error("modification failed")
+				s.status.setTarget(namespace, name, src, err)
+				s.eventReplica(ctx, src, namespace, name, coreV1.EventTypeWarning, EventReasonReplicationFailed, "Modification of %s failed: %s", s.task.describeSource(), err.Error())
+				s.event(src, coreV1.EventTypeWarning, EventReasonReplicationFailed, "Modification for %s failed: %s", key, err.Error())
+				continue
 			}
-		}
-	}()
-
-	// watch for namespace changes
-	watchNamespace := rg.Must(s.client.CoreV1().Namespaces().Watch(ctx, metaV1.ListOptions{}))
-	defer watchNamespace.Stop()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for event := range watchNamespace.ResultChan() {
-			if err = func() (err error) {
-				defer rg.Guard(&err)
-				switch event.Type {
-				case watch.Added:
-					if name := rg.Must(RetrieveMetadataName(event.Object)); s.task.dstNamespace.MatchString(name) {
-						triggers <- name
-					}
-				case watch.Error:
-					err = fmt.Errorf("watch error: %+v", event.Object)
-					return
+
+			log.Info("replicating")
+
+			start := time.Now()
+
+			opts := metaV1.ApplyOptions{
+				Force:        true,
+				FieldManager: FieldManagerReplikator,
+			}
+			if s.dryRun {
+				opts.DryRun = []string{metaV1.DryRunAll}
+			}
+
+			// the watch may deliver the write before Apply returns
+			if !s.dryRun {
+				s.replicas.beginApply(key)
+			}
+
+			var replica *unstructured.Unstructured
+			replica, err = s.dynClient.Resource(s.task.resource).Namespace(namespace).Apply(ctx, name, obj, opts)
+
+			if !s.dryRun {
+				metricApplyDuration.WithLabelValues(s.task.id).Observe(time.Since(start).Seconds())
+			}
+
+			if err != nil {
+				if !s.dryRun {
+					s.replicas.cancelApply(key)
+					metricReplicationFailures.WithLabelValues(s.task.id, namespace).Inc()
 				}
-				return
-			}(); err != nil {
-				cancel()
-				return
+				log.WithError(err).Error("replication failed")
+				failed[namespace] = true
+				s.eventReplica(ctx, src, namespace, name, coreV1.EventTypeWarning, EventReasonReplicationFailed, "Replication of %s failed: %s", s.task.describeSource(), err.Error())
+				s.event(src, coreV1.EventTypeWarning, EventReasonReplicationFailed, "Replication to %s failed: %s", key, err.Error())
+			} else if s.dryRun {
+				// versions are not recorded, so planned changes are logged again on every full synchronization
+				s.logDryRun(ctx, log, replica)
+			} else {
+				metricReplicationSuccesses.WithLabelValues(s.task.id, namespace).Inc()
+				s.versions[key] = rv
+				s.replicas.setApplied(key, replica.GetResourceVersion())
+				s.reconciler.unmarkOrphaned(s.task.resource, namespace, name)
+				s.event(replica, coreV1.EventTypeNormal, EventReasonReplicated, "Replicated from %s/%s at resource version %s", src.GetNamespace(), src.GetName(), rv)
 			}
+			s.status.setTarget(namespace, name, src, err)
 		}
-	}()
+	}
 
-	<-ctx.Done()
+	for _, ns := range namespaces {
+		namespace := ns.Name
 
-	wg.Wait()
+		if !failed[namespace] {
+			s.retries.succeeded(namespace)
+			continue
+		}
 
-	return
-}
+		attempts := s.retries.failed(namespace)
+		s.status.setRetries(namespace, attempts)
 
-// Run the task until context is done
-func (s *Session) Run(ctx context.Context) {
-	triggers := make(chan string, 1)
-	defer close(triggers)
+		if attempts <= RetryLimit {
+			if retries == nil {
+				retries = map[string]int{}
+			}
+			retries[namespace] = attempts
+		} else if attempts == RetryLimit+1 {
+			metricReplicationGiveUps.WithLabelValues(s.task.id, namespace).Inc()
+			s.log.WithField("ns", namespace).WithField("attempts", attempts).Error("replication failed, giving up retries")
+		}
+	}
 
-	if ctx.Err() != nil {
-		return
+	// prune replicas of sources no longer matching the selector
+	if s.task.prune && s.task.srcSelector != nil {
+		err = s.prune(ctx, namespace, sources)
 	}
 
-	go s.Watch(ctx, triggers)
+	return
+}
 
-	for {
-		var namespace string
+// sync synchronizes the task in the namespace, or all namespaces if empty, and reports status,
+// returns namespaces to retry, see Do
+func (s *Session) sync(ctx context.Context, namespace string) (retries map[string]int, err error) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
 
-		select {
-		case <-ctx.Done():
-			return
-		case namespace = <-triggers:
-		case <-time.After(10 * time.Minute):
-			namespace = ""
-		}
+	if retries, err = s.Do(ctx, namespace); err != nil && ctx.Err() == nil {
+		s.log.WithField("ns", namespace).WithError(err).Error("task error")
+	}
 
-		if err := s.Do(ctx, namespace); err != nil {
-			s.log.WithError(err).Error("task error")
-		}
+	// errors are reported by status and retried, a task failing does not block readiness
+	if namespace == "" && ctx.Err() == nil {
+		s.health.setSynced()
 	}
+
+	s.reportStatus(ctx, err, namespace == "")
+
+	return
 }
@@ -1 +1,355 @@
 package replikator
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func TestStripResource(t *testing.T) {
+	src := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]any{
+			"name":              "tls-a",
+			"namespace":         "default",
+			"uid":               "0c6a2d4e",
+			"resourceVersion":   "123",
+			"creationTimestamp": "2024-09-27T00:00:00Z",
+			"labels":            map[string]any{"replicate": "true"},
+		},
+		"data":   map[string]any{"tls.crt": "Y2VydA=="},
+		"status": map[string]any{},
+	}}
+
+	stripResource(src)
+
+	require.Equal(t, map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]any{
+			"name":            "tls-a",
+			"namespace":       "default",
+			"uid":             "0c6a2d4e",
+			"resourceVersion": "123",
+			"labels":          map[string]any{"replicate": "true"},
+			"annotations":     nil,
+		},
+		"data": map[string]any{"tls.crt": "Y2VydA=="},
+	}, src.Object)
+}
+
+func TestSessionCreateReplicatedResource(t *testing.T) {
+	def := TaskDefinition{}
+	def.ID = "test-replicated-resource"
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "tls-a"
+	def.Target.Namespace = ".+"
+	def.Modification.JSONPatch = []any{
+		map[string]any{"op": "remove", "path": "/data/tls.key"},
+	}
+	def.Modification.Javascript = `resource.metadata.labels.copied = "true"`
+	tsk, err := def.Build()
+	require.NoError(t, err)
+
+	src := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]any{
+			"name":            "tls-a",
+			"namespace":       "default",
+			"uid":             "0c6a2d4e",
+			"resourceVersion": "123",
+			"labels":          map[string]any{"replicate": "true"},
+		},
+		"data": map[string]any{"tls.crt": "Y2VydA==", "tls.key": "a2V5"},
+	}}
+
+	s := tsk.NewSession(TaskOptions{})
+
+	obj, err := s.createReplicatedResource(src, "team-a", "tls-copy")
+	require.NoError(t, err)
+	require.Equal(t, "team-a", obj.GetNamespace())
+	require.Equal(t, "tls-copy", obj.GetName())
+	require.Empty(t, obj.GetUID())
+	require.Empty(t, obj.GetResourceVersion())
+	require.Equal(t, map[string]any{"tls.crt": "Y2VydA=="}, obj.Object["data"])
+	require.Equal(t, "true", obj.GetLabels()["copied"])
+	require.Equal(t, "test-replicated-resource", obj.GetLabels()[LabelTask])
+	require.Equal(t, "123", obj.GetAnnotations()[AnnotationSourceResourceVersion])
+	require.Equal(t, 1, testutil.CollectAndCount(metricJavaScriptDuration, "replikator_javascript_duration_seconds"))
+
+	s.task.javascript = `while(true){}`
+	_, err = s.createReplicatedResource(src, "team-a", "tls-copy")
+	require.Equal(t, ErrScriptTimeout, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(metricJavaScriptTimeouts.WithLabelValues("test-replicated-resource")))
+}
+
+// testCluster is a fake cluster for sessions, server-side apply creates or replaces objects,
+// and fails in namespaces of failApply, onApply is called with objects written before Apply returns
+type testCluster struct {
+	client    *kubeFake.Clientset
+	dynClient *dynamicFake.FakeDynamicClient
+	failApply map[string]bool
+	onApply   func(obj *unstructured.Unstructured)
+	applied   []string
+	version   int
+}
+
+func newTestCluster(t *testing.T, namespaces []string, objects ...runtime.Object) *testCluster {
+	var nsObjects []runtime.Object
+	for _, name := range namespaces {
+		nsObjects = append(nsObjects, &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: name}})
+	}
+
+	c := &testCluster{
+		client: kubeFake.NewSimpleClientset(nsObjects...),
+		dynClient: dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			{Version: "v1", Resource: "secrets"}: "SecretList",
+		}, objects...),
+		failApply: map[string]bool{},
+		version:   100,
+	}
+
+	c.dynClient.PrependReactor("patch", "secrets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8sTesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		if c.failApply[patch.GetNamespace()] {
+			return true, nil, errors.NewInternalError(io.ErrUnexpectedEOF)
+		}
+
+		obj := &unstructured.Unstructured{}
+		require.NoError(t, obj.UnmarshalJSON(patch.GetPatch()))
+		c.version++
+		obj.SetResourceVersion(strconv.Itoa(c.version))
+
+		tracker := c.dynClient.Tracker()
+		res := patch.GetResource()
+		if existing, err := tracker.Get(res, patch.GetNamespace(), patch.GetName()); err == nil {
+			obj.SetUID(existing.(metaV1.Object).GetUID())
+			require.NoError(t, tracker.Update(res, obj, patch.GetNamespace()))
+		} else {
+			obj.SetUID(types.UID("uid-" + patch.GetNamespace() + "-" + patch.GetName()))
+			require.NoError(t, tracker.Create(res, obj, patch.GetNamespace()))
+		}
+		c.applied = append(c.applied, patch.GetNamespace()+"/"+patch.GetName())
+		if c.onApply != nil {
+			c.onApply(obj)
+		}
+		return true, obj, nil
+	})
+	return c
+}
+
+// takeApplied returns and clears keys of objects applied
+func (c *testCluster) takeApplied() []string {
+	applied := c.applied
+	c.applied = nil
+	return applied
+}
+
+func (c *testCluster) session(t *testing.T, def TaskDefinition, reconciler *Reconciler) *Session {
+	task, err := def.Build()
+	require.NoError(t, err)
+	return task.NewSession(TaskOptions{Client: c.client, DynamicClient: c.dynClient, Reconciler: reconciler})
+}
+
+func newTestSecret(namespace string, name string, labels map[string]string, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"data":       map[string]any{"token": "c2VjcmV0"},
+	}}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetUID(types.UID("uid-" + namespace + "-" + name))
+	obj.SetResourceVersion("1")
+	obj.SetLabels(labels)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func TestSessionDo(t *testing.T) {
+	c := newTestCluster(t, []string{"default", "team-a", "team-b", "other"},
+		newTestSecret("default", "registry-credentials", nil, nil),
+	)
+	s := c.session(t, testControllerDefinition("do-replicate", false), nil)
+
+	successes := testutil.ToFloat64(metricReplicationSuccesses.WithLabelValues("do-replicate", "team-a"))
+
+	retries, err := s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Empty(t, retries)
+	require.ElementsMatch(t, []string{"team-a/registry-credentials", "team-b/registry-credentials"}, c.takeApplied())
+	require.Equal(t, successes+1, testutil.ToFloat64(metricReplicationSuccesses.WithLabelValues("do-replicate", "team-a")))
+	require.Equal(t, "1", s.versions["team-a/registry-credentials"])
+
+	replica, err := c.dynClient.Resource(s.task.resource).Namespace("team-a").Get(context.Background(), "registry-credentials", metaV1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "do-replicate", replica.GetLabels()[LabelTask])
+
+	// source not changed
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Empty(t, c.takeApplied())
+
+	// replica drifted, the write is delivered by the watch before Apply returns
+	var observed []bool
+	c.onApply = func(obj *unstructured.Unstructured) {
+		observed = append(observed, s.replicas.observe(obj.GetNamespace()+"/"+obj.GetName(), obj.GetResourceVersion(), false))
+	}
+	require.True(t, s.replicas.observe("team-a/registry-credentials", "999", false))
+	_, err = s.Do(context.Background(), "team-a")
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-a/registry-credentials"}, c.takeApplied())
+	require.Equal(t, []bool{false}, observed)
+	require.False(t, s.replicas.takeDrifted("team-a/registry-credentials"))
+}
+
+func TestSessionDoConflict(t *testing.T) {
+	c := newTestCluster(t, []string{"default", "team-a", "team-b"},
+		newTestSecret("default", "registry-credentials", nil, nil),
+		newTestSecret("team-a", "registry-credentials", nil, nil),
+		newTestSecret("team-b", "registry-credentials", nil, map[string]string{AnnotationAdopt: "true"}),
+	)
+
+	// foreign resources are skipped
+	def := testControllerDefinition("do-conflict", false)
+	def.ConflictPolicy = string(ConflictPolicySkip)
+	s := c.session(t, def, nil)
+
+	_, err := s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Empty(t, c.takeApplied())
+	require.Contains(t, s.status.targets["team-a/registry-credentials"].Error, "not owned by replikator")
+	require.Empty(t, s.versions)
+
+	// annotated resources are adopted
+	def.ConflictPolicy = string(ConflictPolicyAdoptIfAnnotated)
+	s = c.session(t, def, nil)
+
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-b/registry-credentials"}, c.takeApplied())
+
+	// replicas owned by the task are overwritten
+	require.NoError(t, c.dynClient.Tracker().Update(s.task.resource, newTestSecret("team-b", "registry-credentials", map[string]string{
+		LabelManaged: "true", LabelTask: "do-conflict",
+	}, nil), "team-b"))
+	def.ConflictPolicy = string(ConflictPolicySkip)
+	s = c.session(t, def, nil)
+
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-b/registry-credentials"}, c.takeApplied())
+}
+
+func TestSessionDoRetries(t *testing.T) {
+	c := newTestCluster(t, []string{"default", "team-a", "team-b"},
+		newTestSecret("default", "registry-credentials", nil, nil),
+	)
+	c.failApply["team-b"] = true
+	s := c.session(t, testControllerDefinition("do-retries", false), nil)
+
+	giveUps := testutil.ToFloat64(metricReplicationGiveUps.WithLabelValues("do-retries", "team-b"))
+
+	// failed namespaces are retried, with consecutive failures
+	for i := 1; i <= RetryLimit; i++ {
+		retries, err := s.Do(context.Background(), "")
+		require.NoError(t, err)
+		require.Equal(t, map[string]int{"team-b": i}, retries)
+	}
+	require.Equal(t, RetryLimit, s.status.targets["team-b/registry-credentials"].Retries)
+
+	// given up
+	retries, err := s.Do(context.Background(), "team-b")
+	require.NoError(t, err)
+	require.Empty(t, retries)
+	require.True(t, s.status.targets["team-b/registry-credentials"].GaveUp)
+	require.Equal(t, giveUps+1, testutil.ToFloat64(metricReplicationGiveUps.WithLabelValues("do-retries", "team-b")))
+
+	// succeeded
+	c.failApply["team-b"] = false
+	retries, err = s.Do(context.Background(), "team-b")
+	require.NoError(t, err)
+	require.Empty(t, retries)
+	require.Equal(t, 1, s.retries.failed("team-b"))
+}
+
+func TestSessionDoPrune(t *testing.T) {
+	replicaLabels := map[string]string{LabelManaged: "true", LabelTask: "do-prune", LabelPrune: "true"}
+	c := newTestCluster(t, []string{"default", "team-a", "other"},
+		newTestSecret("team-a", "registry-credentials", replicaLabels, nil),
+		newTestSecret("other", "registry-credentials", replicaLabels, nil),
+	)
+	r := NewReconciler(ReconcilerOptions{})
+	s := c.session(t, testControllerDefinition("do-prune", true), r)
+
+	// namespace stops matching, replicas are marked, not deleted
+	_, err := s.Do(context.Background(), "other")
+	require.NoError(t, err)
+	require.Len(t, r.copyMarks(), 1)
+	require.Contains(t, r.copyMarks(), orphanKey(s.task.resource, "other", "registry-credentials"))
+
+	// source not found
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, r.copyMarks(), 2)
+	require.Empty(t, c.takeApplied())
+
+	_, err = c.dynClient.Resource(s.task.resource).Namespace("team-a").Get(context.Background(), "registry-credentials", metaV1.GetOptions{})
+	require.NoError(t, err)
+
+	// replicated again
+	require.NoError(t, c.dynClient.Tracker().Add(newTestSecret("default", "registry-credentials", nil, nil)))
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-a/registry-credentials"}, c.takeApplied())
+	require.Len(t, r.copyMarks(), 1)
+}
+
+func TestSessionDoDryRun(t *testing.T) {
+	c := newTestCluster(t, []string{"default", "team-a"},
+		newTestSecret("default", "registry-credentials", nil, nil),
+	)
+	def := testControllerDefinition("do-dry-run", true)
+	def.DryRun = true
+	r := NewReconciler(ReconcilerOptions{})
+	s := c.session(t, def, r)
+
+	successes := testutil.ToFloat64(metricReplicationSuccesses.WithLabelValues("do-dry-run", "team-a"))
+
+	_, err := s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-a/registry-credentials"}, c.takeApplied())
+	require.Empty(t, s.versions)
+	require.Equal(t, successes, testutil.ToFloat64(metricReplicationSuccesses.WithLabelValues("do-dry-run", "team-a")))
+
+	// planned changes are computed again
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-a/registry-credentials"}, c.takeApplied())
+
+	// replicas are not marked orphaned
+	require.NoError(t, c.dynClient.Tracker().Delete(s.task.resource, "default", "registry-credentials"))
+	_, err = s.Do(context.Background(), "")
+	require.NoError(t, err)
+	require.Empty(t, r.copyMarks())
+}
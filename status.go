@@ -0,0 +1,183 @@
+package replikator
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/yankeguo/rg"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// SourceStatus is the status of a source resource
+type SourceStatus struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// TargetStatus is the replication status of a target resource
+type TargetStatus struct {
+	Namespace             string `json:"namespace"`
+	Name                  string `json:"name"`
+	Source                string `json:"source"`
+	SourceResourceVersion string `json:"sourceResourceVersion,omitempty"`
+	Synced                bool   `json:"synced"`
+	Error                 string `json:"error,omitempty"`
+	Retries               int    `json:"retries,omitempty"`
+	GaveUp                bool   `json:"gaveUp,omitempty"`
+}
+
+// TaskStatus is the replication status of a task
+type TaskStatus struct {
+	LastSyncTime string         `json:"lastSyncTime,omitempty"`
+	Sources      []SourceStatus `json:"sources,omitempty"`
+	Targets      []TargetStatus `json:"targets,omitempty"`
+	LastError    string         `json:"lastError,omitempty"`
+}
+
+// taskStatusTracker tracks the status of a task, in a session
+type taskStatusTracker struct {
+	lastSyncTime time.Time
+	lastError    string
+	sources      []SourceStatus
+	targets      map[string]TargetStatus
+	written      *TaskStatus
+}
+
+func (t *taskStatusTracker) setSources(sources []*unstructured.Unstructured) {
+	t.sources = nil
+	for _, src := range sources {
+		t.sources = append(t.sources, SourceStatus{Name: src.GetName(), ResourceVersion: src.GetResourceVersion()})
+	}
+}
+
+func (t *taskStatusTracker) setTarget(namespace string, name string, src *unstructured.Unstructured, err error) {
+	if t.targets == nil {
+		t.targets = map[string]TargetStatus{}
+	}
+	status := TargetStatus{
+		Namespace:             namespace,
+		Name:                  name,
+		Source:                src.GetName(),
+		SourceResourceVersion: src.GetResourceVersion(),
+		Synced:                err == nil,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	t.targets[namespace+"/"+name] = status
+}
+
+// setRetries records consecutive failures of targets failed in the namespace
+func (t *taskStatusTracker) setRetries(namespace string, attempts int) {
+	for key, target := range t.targets {
+		if target.Namespace != namespace || target.Synced {
+			continue
+		}
+		target.Retries = attempts
+		target.GaveUp = attempts > RetryLimit
+		t.targets[key] = target
+	}
+}
+
+func (t *taskStatusTracker) removeTarget(namespace string, name string) {
+	delete(t.targets, namespace+"/"+name)
+}
+
+// removeNamespace removes all targets in the namespace, e.g. namespace deleted
+func (t *taskStatusTracker) removeNamespace(namespace string) {
+	for key, target := range t.targets {
+		if target.Namespace == namespace {
+			delete(t.targets, key)
+		}
+	}
+}
+
+// update records the result of a synchronization, returns the status if it should be written
+func (t *taskStatusTracker) update(err error, full bool) (status TaskStatus, ok bool) {
+	if err == nil {
+		t.lastSyncTime = time.Now()
+		t.lastError = ""
+	} else {
+		t.lastError = err.Error()
+	}
+
+	if !t.lastSyncTime.IsZero() {
+		status.LastSyncTime = t.lastSyncTime.UTC().Format(time.RFC3339)
+	}
+	status.LastError = t.lastError
+	status.Sources = t.sources
+	for _, target := range t.targets {
+		status.Targets = append(status.Targets, target)
+	}
+	sort.Slice(status.Targets, func(i, j int) bool {
+		if status.Targets[i].Namespace == status.Targets[j].Namespace {
+			return status.Targets[i].Name < status.Targets[j].Name
+		}
+		return status.Targets[i].Namespace < status.Targets[j].Namespace
+	})
+
+	// write on full synchronization, or on changes other than lastSyncTime
+	if full || t.written == nil {
+		ok = true
+	} else {
+		written := *t.written
+		written.LastSyncTime = status.LastSyncTime
+		ok = !reflect.DeepEqual(written, status)
+	}
+	return
+}
+
+// writeStatus writes task status to the Replication custom resource, or the status ConfigMap
+func (s *Session) writeStatus(ctx context.Context, status TaskStatus) (err error) {
+	defer rg.Guard(&err)
+
+	if s.dryRun {
+		return
+	}
+
+	if ref := s.task.replication; ref != nil {
+		buf := rg.Must(json.Marshal(map[string]any{"status": status}))
+		rg.Must(s.dynClient.Resource(ReplicationResource).Namespace(ref.Namespace).Patch(ctx, ref.Name, types.MergePatchType, buf, metaV1.PatchOptions{
+			FieldManager: FieldManagerReplikator,
+		}, "status"))
+	} else if ref := s.statusConfigMap; ref.Name != "" {
+		data := string(rg.Must(yaml.Marshal(status)))
+		buf := rg.Must(json.Marshal(map[string]any{"data": map[string]any{s.task.id: data}}))
+
+		client := s.client.CoreV1().ConfigMaps(ref.Namespace)
+		if _, err = client.Patch(ctx, ref.Name, types.MergePatchType, buf, metaV1.PatchOptions{
+			FieldManager: FieldManagerReplikator,
+		}); errors.IsNotFound(err) {
+			_, err = client.Create(ctx, &coreV1.ConfigMap{
+				ObjectMeta: metaV1.ObjectMeta{Namespace: ref.Namespace, Name: ref.Name},
+				Data:       map[string]string{s.task.id: data},
+			}, metaV1.CreateOptions{FieldManager: FieldManagerReplikator})
+		}
+		rg.Must0(err)
+	} else {
+		return
+	}
+
+	s.status.written = &status
+
+	return
+}
+
+// reportStatus records the result of a synchronization, and writes the status if needed
+func (s *Session) reportStatus(ctx context.Context, err error, full bool) {
+	status, ok := s.status.update(err, full)
+	if !ok {
+		return
+	}
+	if err := s.writeStatus(ctx, status); err != nil && ctx.Err() == nil {
+		s.log.WithError(err).Error("failed to write status")
+	}
+}
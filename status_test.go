@@ -0,0 +1,63 @@
+package replikator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestTaskStatusTracker(t *testing.T) {
+	src := &unstructured.Unstructured{Object: map[string]any{}}
+	src.SetName("registry-credentials")
+	src.SetResourceVersion("123")
+
+	tracker := &taskStatusTracker{}
+	tracker.setSources([]*unstructured.Unstructured{src})
+	tracker.setTarget("team-b", "registry-credentials", src, errors.New("quota exceeded"))
+	tracker.setTarget("team-a", "registry-credentials", src, nil)
+
+	status, ok := tracker.update(nil, false)
+	require.True(t, ok)
+	require.NotEmpty(t, status.LastSyncTime)
+	require.Empty(t, status.LastError)
+	require.Equal(t, []SourceStatus{{Name: "registry-credentials", ResourceVersion: "123"}}, status.Sources)
+	require.Equal(t, []TargetStatus{
+		{Namespace: "team-a", Name: "registry-credentials", Source: "registry-credentials", SourceResourceVersion: "123", Synced: true},
+		{Namespace: "team-b", Name: "registry-credentials", Source: "registry-credentials", SourceResourceVersion: "123", Error: "quota exceeded"},
+	}, status.Targets)
+
+	tracker.written = &status
+
+	// unchanged
+	_, ok = tracker.update(nil, false)
+	require.False(t, ok)
+
+	// full synchronization
+	_, ok = tracker.update(nil, true)
+	require.True(t, ok)
+
+	// target removed
+	tracker.removeTarget("team-b", "registry-credentials")
+	status, ok = tracker.update(nil, false)
+	require.True(t, ok)
+	require.Len(t, status.Targets, 1)
+
+	tracker.written = &status
+
+	// task error
+	status, ok = tracker.update(errors.New("source not found"), false)
+	require.True(t, ok)
+	require.Equal(t, "source not found", status.LastError)
+
+	// retries of failed targets
+	tracker.setTarget("team-b", "registry-credentials", src, errors.New("quota exceeded"))
+	tracker.setRetries("team-a", 3)
+	tracker.setRetries("team-b", RetryLimit+1)
+	status, _ = tracker.update(nil, false)
+	require.Equal(t, []TargetStatus{
+		{Namespace: "team-a", Name: "registry-credentials", Source: "registry-credentials", SourceResourceVersion: "123", Synced: true},
+		{Namespace: "team-b", Name: "registry-credentials", Source: "registry-credentials", SourceResourceVersion: "123", Error: "quota exceeded", Retries: RetryLimit + 1, GaveUp: true},
+	}, status.Targets)
+}
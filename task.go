@@ -1,15 +1,33 @@
 package replikator
 
 import (
+	"bytes"
+	"errors"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"text/template"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/sirupsen/logrus"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// AnnotationNamespaceSkip opts a namespace out of replication, see Task.isReferencedBy for the format
+	AnnotationNamespaceSkip = "replikator.yankeguo.io/skip"
+	// AnnotationNamespaceWant opts a namespace in for replication of tasks with target.optIn
+	AnnotationNamespaceWant = "replikator.yankeguo.io/want"
 )
 
 var (
@@ -26,33 +44,233 @@ func (list TaskList) NewSessions(opts TaskOptions) (out SessionList) {
 }
 
 type Task struct {
+	id string
+
 	resource     schema.GroupVersionResource
 	srcNamespace string
 	srcName      string
+	srcSelector  labels.Selector
 	dstNamespace *regexp.Regexp
 	dstName      string
 
+	dstNameTemplate *template.Template
+
+	dstNamespaceSelector labels.Selector
+
+	dstExcludeNamespaces        []*regexp.Regexp
+	dstExcludeNamespaceSelector labels.Selector
+
+	dstOptIn bool
+
 	javascript string
 	jsonpatch  jsonpatch.Patch
+
+	prune          bool
+	conflictPolicy ConflictPolicy
+
+	dryRun bool
+
+	// resyncPeriod overrides TaskOptions.ResyncPeriod if set
+	resyncPeriod *time.Duration
+
+	replication *types.NamespacedName
 }
 
 // TaskOptions is the options for creating a new session
 type TaskOptions struct {
-	Client        *kubernetes.Clientset
-	DynamicClient *dynamic.DynamicClient
+	Client        kubernetes.Interface
+	DynamicClient dynamic.Interface
+	// StatusConfigMap is the ConfigMap to write status of tasks not from Replication custom resources, optional
+	StatusConfigMap types.NamespacedName
+	// EventRecorder records Kubernetes Events for replication outcomes, optional
+	EventRecorder record.EventRecorder
+	// DryRun only logs planned changes of all tasks, nothing is persisted
+	DryRun bool
+	// ResyncPeriod is the period of full synchronizations, of tasks without resyncPeriod, 0 to disable
+	ResyncPeriod time.Duration
+	// Reconciler deletes replicas pruned by sessions after grace period, replicas are never pruned if not set
+	Reconciler *Reconciler
 }
 
 // NewSession creates a new session for the task with kubernetes client and dynamic client
 func (t *Task) NewSession(opts TaskOptions) *Session {
 	session := strconv.FormatInt(atomic.AddInt64(&sessionCounter, 1), 10)
+	dryRun := opts.DryRun || t.dryRun
+	recorder := opts.EventRecorder
+	if dryRun {
+		// events are persisted, not recorded in dry-run
+		recorder = nil
+	}
+	resyncPeriod := opts.ResyncPeriod
+	if t.resyncPeriod != nil {
+		resyncPeriod = *t.resyncPeriod
+	}
 	return &Session{
 		task:      t,
 		client:    opts.Client,
 		dynClient: opts.DynamicClient,
-		log: logrus.WithField("res", t.resource.String()).
-			WithField("src", t.srcNamespace+"/"+t.srcName).
-			WithField("dst", t.dstNamespace.String()+"/"+t.dstName).
-			WithField("session", session),
-		versions: map[string]string{},
+		log: logrus.WithField("task", t.id).
+			WithField("res", t.resource.String()).
+			WithField("src", t.describeSource()).
+			WithField("dst", t.describeTarget()).
+			WithField("session", session).
+			WithField("dryRun", dryRun),
+		versions:        map[string]string{},
+		statusConfigMap: opts.StatusConfigMap,
+		recorder:        recorder,
+		reconciler:      opts.Reconciler,
+		resyncPeriod:    resyncPeriod,
+		dryRun:          dryRun,
+	}
+}
+
+// ID returns the id of the task
+func (t *Task) ID() string {
+	return t.id
+}
+
+// Modify runs modifications of the task on the source resource, as replicated to the namespace, without accessing the cluster,
+// labels and annotations of the namespace are used by target name templates
+func (t *Task) Modify(src *unstructured.Unstructured, ns metaV1.Object) (obj *unstructured.Unstructured, err error) {
+	src = src.DeepCopy()
+	stripResource(src)
+
+	var name string
+	if name, err = t.targetName(src, ns); err != nil {
+		return
+	}
+
+	return (&Session{task: t}).createReplicatedResource(src, ns.GetName(), name)
+}
+
+// isSource checks whether the object is a source of the task
+func (t *Task) isSource(obj metaV1.Object) bool {
+	if obj.GetNamespace() != t.srcNamespace {
+		return false
+	}
+	if t.srcSelector != nil {
+		return t.srcSelector.Matches(labels.Set(obj.GetLabels()))
+	}
+	return obj.GetName() == t.srcName
+}
+
+// describeSource returns a human readable description of source namespace and name
+func (t *Task) describeSource() string {
+	if t.srcSelector != nil {
+		return t.srcNamespace + "/{" + t.srcSelector.String() + "}"
+	}
+	return t.srcNamespace + "/" + t.srcName
+}
+
+// targetNameObject is the object exposed to target name template
+type targetNameObject struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func newTargetNameObject(obj metaV1.Object) targetNameObject {
+	return targetNameObject{
+		Name:        obj.GetName(),
+		Namespace:   obj.GetNamespace(),
+		Labels:      obj.GetLabels(),
+		Annotations: obj.GetAnnotations(),
+	}
+}
+
+// targetName returns the name of the replica for the source resource in the namespace
+func (t *Task) targetName(src metaV1.Object, ns metaV1.Object) (name string, err error) {
+	if t.dstNameTemplate != nil {
+		buf := &bytes.Buffer{}
+		if err = t.dstNameTemplate.Execute(buf, map[string]any{
+			"Source":    newTargetNameObject(src),
+			"Namespace": newTargetNameObject(ns),
+		}); err != nil {
+			return
+		}
+		if name = strings.TrimSpace(buf.String()); name == "" {
+			err = errors.New("target.name template rendered empty name")
+		} else if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			err = errors.New("target.name template rendered invalid name " + strconv.Quote(name) + ": " + strings.Join(errs, ", "))
+		}
+		return
+	}
+	if t.dstName != "" {
+		name = t.dstName
+		return
+	}
+	name = src.GetName()
+	return
+}
+
+// describeTarget returns a human readable description of target namespaces and name
+func (t *Task) describeTarget() string {
+	var namespace string
+	if t.dstNamespace != nil {
+		namespace = t.dstNamespace.String()
+	}
+	if t.dstNamespaceSelector != nil {
+		if namespace != "" {
+			namespace += ","
+		}
+		namespace += "{" + t.dstNamespaceSelector.String() + "}"
+	}
+	if t.dstOptIn {
+		if namespace != "" {
+			namespace += ","
+		}
+		namespace += "opt-in"
+	}
+	name := t.dstName
+	if name == "" {
+		name = "*"
+	}
+	return namespace + "/" + name
+}
+
+// isReferencedBy checks whether a comma separated list of references contains the task,
+// a reference is either '*', the task id, or '<resource>/<name>'
+func (t *Task) isReferencedBy(refs string) bool {
+	for _, ref := range strings.Split(refs, ",") {
+		ref = strings.TrimSpace(ref)
+		if ref == "*" || ref == t.id || (t.dstNameTemplate == nil && t.dstName != "" && ref == t.resource.Resource+"/"+t.dstName) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchNamespace checks whether the namespace is a replication target of the task
+func (t *Task) matchNamespace(ns metaV1.Object) bool {
+	namespace, nsLabels, nsAnnotations := ns.GetName(), ns.GetLabels(), ns.GetAnnotations()
+
+	// skip source namespace
+	if namespace == t.srcNamespace {
+		return false
+	}
+	// skip opted-out namespaces
+	if t.isReferencedBy(nsAnnotations[AnnotationNamespaceSkip]) {
+		return false
+	}
+	// skip not opted-in namespaces
+	if t.dstOptIn && !t.isReferencedBy(nsAnnotations[AnnotationNamespaceWant]) {
+		return false
+	}
+	if t.dstNamespace != nil && !t.dstNamespace.MatchString(namespace) {
+		return false
+	}
+	if t.dstNamespaceSelector != nil && !t.dstNamespaceSelector.Matches(labels.Set(nsLabels)) {
+		return false
+	}
+	// skip excluded namespaces
+	for _, re := range t.dstExcludeNamespaces {
+		if re.MatchString(namespace) {
+			return false
+		}
+	}
+	if t.dstExcludeNamespaceSelector != nil && t.dstExcludeNamespaceSelector.Matches(labels.Set(nsLabels)) {
+		return false
 	}
+	return true
 }
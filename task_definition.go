@@ -12,40 +12,104 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"text/template"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/yankeguo/rg"
 	"gopkg.in/yaml.v3"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type TaskDefinitionList []TaskDefinition
 
+// Build creates Tasks from TaskDefinitionList, ids of tasks must be unique, since replicas are labeled by task id
 func (defs TaskDefinitionList) Build() (tasks TaskList, err error) {
+	ids := map[string]struct{}{}
 	for _, def := range defs {
 		var task *Task
 		if task, err = def.Build(); err != nil {
 			return
 		}
+		if _, ok := ids[task.id]; ok {
+			err = errors.New("duplicate task id: " + task.id + ", set a unique id for tasks of the same resource, source and target name")
+			if task.replication != nil {
+				err = errors.New("duplicate task id: " + task.id + ", from Replication " + task.replication.String())
+			}
+			return
+		}
+		ids[task.id] = struct{}{}
 		tasks = append(tasks, task)
 	}
 	return
 }
 
+// digestTaskID creates a default task id from parts of the task definition
+func digestTaskID(parts ...string) string {
+	h := md5.New()
+	h.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LabelSelectorRequirementDefinition is the definition of a label selector requirement
+type LabelSelectorRequirementDefinition struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values"`
+}
+
+// LabelSelectorDefinition is the definition of a standard kubernetes label selector
+type LabelSelectorDefinition struct {
+	MatchLabels      map[string]string                    `yaml:"matchLabels"`
+	MatchExpressions []LabelSelectorRequirementDefinition `yaml:"matchExpressions"`
+}
+
+// Build creates a labels.Selector from LabelSelectorDefinition
+func (def LabelSelectorDefinition) Build() (selector labels.Selector, err error) {
+	ls := &metaV1.LabelSelector{MatchLabels: def.MatchLabels}
+	for _, expr := range def.MatchExpressions {
+		ls.MatchExpressions = append(ls.MatchExpressions, metaV1.LabelSelectorRequirement{
+			Key:      expr.Key,
+			Operator: metaV1.LabelSelectorOperator(expr.Operator),
+			Values:   expr.Values,
+		})
+	}
+	return metaV1.LabelSelectorAsSelector(ls)
+}
+
 // TaskDefinition is the definition of a Task
 type TaskDefinition struct {
+	ID       string `yaml:"id"`
 	Resource string `yaml:"resource"`
 	Source   struct {
-		Namespace string `yaml:"namespace"`
-		Name      string `yaml:"name"`
+		Namespace string                   `yaml:"namespace"`
+		Name      string                   `yaml:"name"`
+		Selector  *LabelSelectorDefinition `yaml:"selector"`
 	} `yaml:"source"`
 	Target struct {
-		Namespace string `yaml:"namespace"`
-		Name      string `yaml:"name"`
+		Namespace         string                   `yaml:"namespace"`
+		NamespaceSelector *LabelSelectorDefinition `yaml:"namespaceSelector"`
+		Name              string                   `yaml:"name"`
+
+		ExcludeNamespaces        []string                 `yaml:"excludeNamespaces"`
+		ExcludeNamespaceSelector *LabelSelectorDefinition `yaml:"excludeNamespaceSelector"`
+
+		OptIn bool `yaml:"optIn"`
 	} `yaml:"target"`
 	Modification struct {
 		JSONPatch  []any  `yaml:"jsonpatch"`
 		Javascript string `yaml:"javascript"`
 	} `yaml:"modification"`
+	Prune          bool   `yaml:"prune"`
+	ConflictPolicy string `yaml:"conflictPolicy"`
+	DryRun         bool   `yaml:"dryRun"`
+	ResyncPeriod   string `yaml:"resyncPeriod"`
+
+	// Replication is the Replication custom resource this definition comes from, if any
+	Replication *types.NamespacedName `yaml:"-"`
 }
 
 // Build creates a Task from TaskDefinition
@@ -74,27 +138,82 @@ func (def TaskDefinition) Build() (out *Task, err error) {
 	out.srcNamespace = def.Source.Namespace
 
 	// srcName
-	if def.Source.Name == "" {
-		err = errors.New("source.name is required")
+	if def.Source.Name == "" && def.Source.Selector == nil {
+		err = errors.New("source.name or source.selector is required")
+		return
+	}
+	if def.Source.Name != "" && def.Source.Selector != nil {
+		err = errors.New("source.name and source.selector are mutually exclusive")
 		return
 	}
 	out.srcName = def.Source.Name
 
+	// srcSelector
+	if def.Source.Selector != nil {
+		if out.srcSelector, err = def.Source.Selector.Build(); err != nil {
+			return
+		}
+		if out.srcSelector.Empty() {
+			err = errors.New("source.selector must not be empty")
+			return
+		}
+		// replicas of multiple sources can not share the same name
+		if def.Target.Name != "" && !strings.Contains(def.Target.Name, "{{") {
+			err = errors.New("target.name must be a template with source.selector")
+			return
+		}
+	}
+
 	// dstNamespace
-	if def.Target.Namespace == "" {
-		err = errors.New("target.namespace is required")
+	if def.Target.Namespace == "" && def.Target.NamespaceSelector == nil && !def.Target.OptIn {
+		err = errors.New("target.namespace, target.namespaceSelector or target.optIn is required")
 		return
 	}
-	if out.dstNamespace, err = regexp.Compile(def.Target.Namespace); err != nil {
-		return
+	if def.Target.Namespace != "" {
+		if out.dstNamespace, err = regexp.Compile(def.Target.Namespace); err != nil {
+			return
+		}
 	}
 
+	// dstNamespaceSelector
+	if def.Target.NamespaceSelector != nil {
+		if out.dstNamespaceSelector, err = def.Target.NamespaceSelector.Build(); err != nil {
+			return
+		}
+	}
+
+	// dstExcludeNamespaces
+	for _, item := range def.Target.ExcludeNamespaces {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(item); err != nil {
+			return
+		}
+		out.dstExcludeNamespaces = append(out.dstExcludeNamespaces, re)
+	}
+
+	// dstExcludeNamespaceSelector
+	if def.Target.ExcludeNamespaceSelector != nil {
+		if out.dstExcludeNamespaceSelector, err = def.Target.ExcludeNamespaceSelector.Build(); err != nil {
+			return
+		}
+	}
+
+	// dstOptIn
+	out.dstOptIn = def.Target.OptIn
+
 	// dstName
 	if def.Target.Name == "" {
 		def.Target.Name = def.Source.Name
 	}
 	out.dstName = def.Target.Name
 
+	// dstNameTemplate
+	if strings.Contains(out.dstName, "{{") {
+		if out.dstNameTemplate, err = template.New("target.name").Option("missingkey=error").Parse(out.dstName); err != nil {
+			return
+		}
+	}
+
 	// jsonpatch
 	if len(def.Modification.JSONPatch) > 0 {
 		var buf []byte
@@ -109,6 +228,48 @@ func (def TaskDefinition) Build() (out *Task, err error) {
 	// javascript
 	out.javascript = strings.TrimSpace(def.Modification.Javascript)
 
+	// prune
+	out.prune = def.Prune
+
+	// conflictPolicy
+	if out.conflictPolicy, err = ParseConflictPolicy(def.ConflictPolicy); err != nil {
+		return
+	}
+
+	// dryRun
+	out.dryRun = def.DryRun
+
+	// resyncPeriod
+	if def.ResyncPeriod != "" {
+		var period time.Duration
+		if period, err = time.ParseDuration(def.ResyncPeriod); err != nil {
+			return
+		}
+		if period < 0 {
+			err = errors.New("resyncPeriod must not be negative")
+			return
+		}
+		out.resyncPeriod = &period
+	}
+
+	// replication
+	out.replication = def.Replication
+
+	// id
+	if def.ID == "" {
+		srcName := out.srcName
+		if out.srcSelector != nil {
+			srcName = "{" + out.srcSelector.String() + "}"
+		}
+		// target namespaces are excluded, replicas are still owned by the task after target namespaces are changed
+		def.ID = digestTaskID(out.resource.String(), out.srcNamespace, srcName, out.dstName)
+	}
+	if errs := validation.IsValidLabelValue(def.ID); len(errs) > 0 {
+		err = errors.New("invalid id: " + strings.Join(errs, ", "))
+		return
+	}
+	out.id = def.ID
+
 	return
 }
 
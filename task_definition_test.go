@@ -32,6 +32,7 @@ func TestTaskDefBuild(t *testing.T) {
 			"path": "/status",
 		},
 	}
+	def.Prune = true
 	tsk, err := def.Build()
 	require.NoError(t, err)
 	require.Equal(t, schema.GroupVersionResource{
@@ -47,6 +48,27 @@ func TestTaskDefBuild(t *testing.T) {
 	require.Len(t, tsk.jsonpatch, 1)
 	require.Equal(t, "\"remove\"", string(*tsk.jsonpatch[0]["op"]))
 	require.Equal(t, "\"/status\"", string(*tsk.jsonpatch[0]["path"]))
+	require.True(t, tsk.prune)
+	require.Len(t, tsk.id, 32)
+
+	def.ID = "custom-id"
+	tsk, err = def.Build()
+	require.NoError(t, err)
+	require.Equal(t, "custom-id", tsk.id)
+
+	def.ID = "invalid/id"
+	_, err = def.Build()
+	require.Error(t, err)
+
+	def.ID = ""
+	def.ConflictPolicy = "skip"
+	tsk, err = def.Build()
+	require.NoError(t, err)
+	require.Equal(t, ConflictPolicySkip, tsk.conflictPolicy)
+
+	def.ConflictPolicy = "invalid"
+	_, err = def.Build()
+	require.Error(t, err)
 }
 
 func TestLoadTaskDefinitionsFromFile(t *testing.T) {
@@ -82,6 +104,29 @@ func TestTaskDefinitionListBuild(t *testing.T) {
 
 	_, err = defs.Build()
 	require.NoError(t, err)
+
+	// default id does not change with target namespaces
+	task, err := defs[0].Build()
+	require.NoError(t, err)
+	def := defs[0]
+	def.Target.Namespace = "^team-"
+	changed, err := def.Build()
+	require.NoError(t, err)
+	require.Equal(t, task.id, changed.id)
+
+	// same source and target name, different target namespaces
+	defs = TaskDefinitionList{defs[0], def}
+	_, err = defs.Build()
+	require.ErrorContains(t, err, "duplicate task id")
+
+	defs[1].ID = "registry-credentials-team"
+	_, err = defs.Build()
+	require.NoError(t, err)
+
+	defs[0].ID = "registry-credentials"
+	defs[1].ID = "registry-credentials"
+	_, err = defs.Build()
+	require.ErrorContains(t, err, "duplicate task id: registry-credentials")
 }
 
 func TestLoadTaskDefinitionFromDir(t *testing.T) {
@@ -95,3 +140,20 @@ func TestDigestTaskDefinitionsFromDir(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "972f2f3da7a70102d2317725b7366a77", digest)
 }
+
+func TestLabelSelectorDefinitionBuild(t *testing.T) {
+	def := LabelSelectorDefinition{
+		MatchLabels: map[string]string{"team": "a"},
+		MatchExpressions: []LabelSelectorRequirementDefinition{
+			{Key: "env", Operator: "In", Values: []string{"prod", "staging"}},
+		},
+	}
+
+	selector, err := def.Build()
+	require.NoError(t, err)
+	require.Equal(t, "env in (prod,staging),team=a", selector.String())
+
+	def.MatchExpressions[0].Operator = "Invalid"
+	_, err = def.Build()
+	require.Error(t, err)
+}
@@ -5,8 +5,15 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
 )
 
+func testNamespace(name string, labels map[string]string) metaV1.Object {
+	return &metaV1.ObjectMeta{Name: name, Labels: labels}
+}
+
 func TestTaskNewSession(t *testing.T) {
 	defs, err := LoadTaskDefinitionsFromFile(filepath.Join("testdata", "task2.yaml"))
 	require.NoError(t, err)
@@ -16,4 +23,286 @@ func TestTaskNewSession(t *testing.T) {
 
 	session := tasks[0].NewSession(TaskOptions{})
 	require.NotNil(t, session)
+	require.False(t, session.dryRun)
+
+	session = tasks[0].NewSession(TaskOptions{DryRun: true, EventRecorder: record.NewFakeRecorder(1)})
+	require.True(t, session.dryRun)
+	require.Nil(t, session.recorder)
+
+	defs[0].DryRun = true
+	tasks, err = defs.Build()
+	require.NoError(t, err)
+
+	session = tasks[0].NewSession(TaskOptions{})
+	require.True(t, session.dryRun)
+
+	// resync period of the task overrides the default
+	session = tasks[0].NewSession(TaskOptions{ResyncPeriod: DefaultResyncPeriod})
+	require.Equal(t, DefaultResyncPeriod, session.resyncPeriod)
+
+	defs[0].ResyncPeriod = "0"
+	tasks, err = defs.Build()
+	require.NoError(t, err)
+
+	session = tasks[0].NewSession(TaskOptions{ResyncPeriod: DefaultResyncPeriod})
+	require.Zero(t, session.resyncPeriod)
+
+	defs[0].ResyncPeriod = "-1m"
+	_, err = defs.Build()
+	require.Error(t, err)
+}
+
+func TestTaskMatchNamespace(t *testing.T) {
+	defs, err := LoadTaskDefinitionsFromFile(filepath.Join("testdata", "task2.yaml"))
+	require.NoError(t, err)
+
+	tasks, err := defs.Build()
+	require.NoError(t, err)
+
+	require.True(t, tasks[0].matchNamespace(testNamespace("default", nil)))
+	require.False(t, tasks[0].matchNamespace(testNamespace("auto-ops", nil)))
+}
+
+func TestTaskMatchNamespaceSelector(t *testing.T) {
+	def := TaskDefinition{}
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.NamespaceSelector = &LabelSelectorDefinition{
+		MatchLabels: map[string]string{"team": "a"},
+	}
+	tsk, err := def.Build()
+	require.NoError(t, err)
+	require.Equal(t, "{team=a}/registry-credentials", tsk.describeTarget())
+
+	require.True(t, tsk.matchNamespace(testNamespace("team-a-prod", map[string]string{"team": "a"})))
+	require.False(t, tsk.matchNamespace(testNamespace("team-b-prod", map[string]string{"team": "b"})))
+	require.False(t, tsk.matchNamespace(testNamespace("default", map[string]string{"team": "a"})))
+
+	def.Target.Namespace = "-prod$"
+	tsk, err = def.Build()
+	require.NoError(t, err)
+	require.Equal(t, "-prod$,{team=a}/registry-credentials", tsk.describeTarget())
+
+	require.True(t, tsk.matchNamespace(testNamespace("team-a-prod", map[string]string{"team": "a"})))
+	require.False(t, tsk.matchNamespace(testNamespace("team-a-dev", map[string]string{"team": "a"})))
+}
+
+func TestTaskMatchNamespaceExclusion(t *testing.T) {
+	def := TaskDefinition{}
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = ".+"
+	def.Target.ExcludeNamespaces = []string{"^kube-system$", "^kube-public$", "-sandbox$"}
+	def.Target.ExcludeNamespaceSelector = &LabelSelectorDefinition{
+		MatchLabels: map[string]string{"replikator": "disabled"},
+	}
+	tsk, err := def.Build()
+	require.NoError(t, err)
+
+	require.True(t, tsk.matchNamespace(testNamespace("team-a", nil)))
+	require.True(t, tsk.matchNamespace(testNamespace("kube-system-extra", nil)))
+	require.False(t, tsk.matchNamespace(testNamespace("kube-system", nil)))
+	require.False(t, tsk.matchNamespace(testNamespace("kube-public", nil)))
+	require.False(t, tsk.matchNamespace(testNamespace("team-a-sandbox", nil)))
+	require.False(t, tsk.matchNamespace(testNamespace("team-b", map[string]string{"replikator": "disabled"})))
+
+	def.Target.ExcludeNamespaces = []string{"("}
+	_, err = def.Build()
+	require.Error(t, err)
+}
+
+func TestTaskMatchNamespaceAnnotations(t *testing.T) {
+	def := TaskDefinition{}
+	def.ID = "registry"
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = ".+"
+	tsk, err := def.Build()
+	require.NoError(t, err)
+
+	ns := &metaV1.ObjectMeta{Name: "team-a"}
+	require.True(t, tsk.matchNamespace(ns))
+
+	ns.Annotations = map[string]string{AnnotationNamespaceSkip: "configmaps/registry-credentials"}
+	require.True(t, tsk.matchNamespace(ns))
+
+	ns.Annotations = map[string]string{AnnotationNamespaceSkip: "configmaps/other, secrets/registry-credentials"}
+	require.False(t, tsk.matchNamespace(ns))
+
+	ns.Annotations = map[string]string{AnnotationNamespaceSkip: "registry"}
+	require.False(t, tsk.matchNamespace(ns))
+
+	ns.Annotations = map[string]string{AnnotationNamespaceSkip: "*"}
+	require.False(t, tsk.matchNamespace(ns))
+
+	// opt-in
+	def.Target.Namespace = ""
+	def.Target.OptIn = true
+	tsk, err = def.Build()
+	require.NoError(t, err)
+
+	ns.Annotations = nil
+	require.False(t, tsk.matchNamespace(ns))
+
+	ns.Annotations = map[string]string{AnnotationNamespaceWant: "secrets/registry-credentials"}
+	require.True(t, tsk.matchNamespace(ns))
+
+	ns.Annotations = map[string]string{
+		AnnotationNamespaceWant: "secrets/registry-credentials",
+		AnnotationNamespaceSkip: "secrets/registry-credentials",
+	}
+	require.False(t, tsk.matchNamespace(ns))
+}
+
+func TestTaskSourceSelector(t *testing.T) {
+	def := TaskDefinition{}
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Selector = &LabelSelectorDefinition{
+		MatchLabels: map[string]string{"replicate": "true"},
+	}
+	def.Target.Namespace = ".+"
+	tsk, err := def.Build()
+	require.NoError(t, err)
+	require.Equal(t, "default/{replicate=true}", tsk.describeSource())
+	require.Equal(t, ".+/*", tsk.describeTarget())
+
+	name, err := tsk.targetName(&metaV1.ObjectMeta{Name: "tls-a"}, testNamespace("team-a", nil))
+	require.NoError(t, err)
+	require.Equal(t, "tls-a", name)
+
+	def.Source.Name = "tls-a"
+	_, err = def.Build()
+	require.Error(t, err)
+
+	def.Source.Name = ""
+	def.Target.Name = "tls"
+	_, err = def.Build()
+	require.Error(t, err)
+
+	def.Target.Name = "{{ .Source.Name }}-copy"
+	_, err = def.Build()
+	require.NoError(t, err)
+
+	def.Target.Name = ""
+	def.Source.Selector = &LabelSelectorDefinition{}
+	_, err = def.Build()
+	require.Error(t, err)
+}
+
+func TestTaskTargetNameTemplate(t *testing.T) {
+	def := TaskDefinition{}
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = ".+"
+	def.Target.Name = "{{ .Source.Name }}-{{ .Namespace.Labels.env }}"
+	tsk, err := def.Build()
+	require.NoError(t, err)
+
+	src := &metaV1.ObjectMeta{Name: "registry-credentials", Namespace: "default"}
+
+	name, err := tsk.targetName(src, testNamespace("team-a", map[string]string{"env": "prod"}))
+	require.NoError(t, err)
+	require.Equal(t, "registry-credentials-prod", name)
+
+	_, err = tsk.targetName(src, testNamespace("team-a", nil))
+	require.Error(t, err)
+
+	// rendered name is not a valid resource name
+	_, err = tsk.targetName(src, testNamespace("team-a", map[string]string{"env": "Prod_1"}))
+	require.ErrorContains(t, err, `target.name template rendered invalid name "registry-credentials-Prod_1"`)
+
+	def.Target.Name = "{{ .Source.Name"
+	_, err = def.Build()
+	require.Error(t, err)
+
+	def.Target.Name = ""
+	tsk, err = def.Build()
+	require.NoError(t, err)
+
+	name, err = tsk.targetName(src, testNamespace("team-a", nil))
+	require.NoError(t, err)
+	require.Equal(t, "registry-credentials", name)
+}
+
+func TestTaskModify(t *testing.T) {
+	var def TaskDefinition
+	def.Resource = "v1/services"
+	def.Source.Namespace = "default"
+	def.Source.Name = "web"
+	def.Target.Namespace = ".+"
+	def.Target.Name = "{{ .Source.Name }}-{{ .Namespace.Labels.team }}"
+	def.Modification.JSONPatch = []any{map[string]any{"op": "remove", "path": "/spec/clusterIP"}}
+	def.Modification.Javascript = "resource.spec.ports.forEach(function (port) { delete port.nodePort })"
+
+	task, err := def.Build()
+	require.NoError(t, err)
+
+	src := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]any{
+			"namespace":       "default",
+			"name":            "web",
+			"uid":             "abc",
+			"resourceVersion": "12",
+		},
+		"spec": map[string]any{
+			"clusterIP": "10.0.0.1",
+			"ports":     []any{map[string]any{"port": int64(80), "nodePort": int64(30080)}},
+		},
+		"status": map[string]any{},
+	}}
+
+	ns := testNamespace("team-a", map[string]string{"team": "alpha"})
+
+	out, err := task.Modify(src, ns)
+	require.NoError(t, err)
+	require.Equal(t, "team-a", out.GetNamespace())
+	require.Equal(t, "web-alpha", out.GetName())
+	require.Empty(t, out.GetUID())
+	require.Equal(t, "12", out.GetAnnotations()[AnnotationSourceResourceVersion])
+	require.Equal(t, map[string]any{
+		"ports": []any{map[string]any{"port": int64(80)}},
+	}, out.Object["spec"])
+	require.NotContains(t, out.Object, "status")
+
+	// source is not modified
+	require.Equal(t, "abc", string(src.GetUID()))
+
+	def.Modification.Javascript = "resource.spec.foo.bar = 1"
+	task, err = def.Build()
+	require.NoError(t, err)
+
+	_, err = task.Modify(src, ns)
+	require.ErrorContains(t, err, "modification.javascript:1:1")
+}
+
+func TestTaskIsSource(t *testing.T) {
+	var def TaskDefinition
+	def.Resource = "secrets"
+	def.Source.Namespace = "default"
+	def.Source.Name = "registry-credentials"
+	def.Target.Namespace = ".+"
+
+	task, err := def.Build()
+	require.NoError(t, err)
+
+	require.True(t, task.isSource(&metaV1.ObjectMeta{Namespace: "default", Name: "registry-credentials"}))
+	require.False(t, task.isSource(&metaV1.ObjectMeta{Namespace: "default", Name: "other"}))
+	require.False(t, task.isSource(&metaV1.ObjectMeta{Namespace: "team-a", Name: "registry-credentials"}))
+
+	def.Source.Name = ""
+	def.Source.Selector = &LabelSelectorDefinition{MatchLabels: map[string]string{"replicate": "true"}}
+	def.Target.Name = "{{ .Source.Name }}"
+
+	task, err = def.Build()
+	require.NoError(t, err)
+
+	require.True(t, task.isSource(&metaV1.ObjectMeta{Namespace: "default", Name: "a", Labels: map[string]string{"replicate": "true"}}))
+	require.False(t, task.isSource(&metaV1.ObjectMeta{Namespace: "default", Name: "b"}))
 }
@@ -0,0 +1,217 @@
+package replikator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/robertkrimen/otto/parser"
+	"github.com/yankeguo/rg"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is an error of a task definition file, with location
+type ValidationError struct {
+	File string
+	// Document is the index of the YAML document in the file, starting from 1
+	Document int
+	// Line is the line in the file, 0 if unknown
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: document %d: %s", e.File, e.Document, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: document %d: %s", e.File, e.Line, e.Document, e.Message)
+}
+
+var regexpYAMLErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// newValidationError creates a ValidationError, line is extracted from messages of yaml errors if not set
+func newValidationError(file string, document int, line int, message string) ValidationError {
+	if line == 0 {
+		if match := regexpYAMLErrorLine.FindStringSubmatch(message); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			message = match[2]
+		}
+	}
+	return ValidationError{File: file, Document: document, Line: line, Message: message}
+}
+
+// findYAMLNode finds the value node of nested keys in a mapping node, returns nil if not found
+func findYAMLNode(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var found *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				found = node.Content[i+1]
+				break
+			}
+		}
+		node = found
+	}
+	return node
+}
+
+// jsonPatchOperations is the supported operations of jsonpatch, with whether 'from' and 'value' are required
+var jsonPatchOperations = map[string]struct {
+	from  bool
+	value bool
+}{
+	"add":     {value: true},
+	"remove":  {},
+	"replace": {value: true},
+	"move":    {from: true},
+	"copy":    {from: true},
+	"test":    {value: true},
+}
+
+// validateJSONPatchOperation validates a single jsonpatch operation
+func validateJSONPatchOperation(op any) error {
+	m, ok := op.(map[string]any)
+	if !ok {
+		return errors.New("jsonpatch operation must be an object")
+	}
+	name, _ := m["op"].(string)
+	spec, ok := jsonPatchOperations[name]
+	if !ok {
+		return fmt.Errorf("jsonpatch operation has unknown op: %q", name)
+	}
+	fields := []string{"path"}
+	if spec.from {
+		fields = append(fields, "from")
+	}
+	for _, field := range fields {
+		pointer, ok := m[field].(string)
+		if !ok {
+			return fmt.Errorf("jsonpatch operation %q requires '%s'", name, field)
+		}
+		if pointer != "" && !strings.HasPrefix(pointer, "/") {
+			return fmt.Errorf("jsonpatch operation %q has invalid '%s', must be a JSON pointer starting with '/': %q", name, field, pointer)
+		}
+	}
+	if _, ok := m["value"]; spec.value && !ok {
+		return fmt.Errorf("jsonpatch operation %q requires 'value'", name)
+	}
+	return nil
+}
+
+// validateTaskDefinitionNode validates a decoded task definition, with the document node for locations
+func validateTaskDefinitionNode(file string, document int, def TaskDefinition, node *yaml.Node) (errs []ValidationError) {
+	line := node.Line
+
+	if _, err := def.Build(); err != nil {
+		errs = append(errs, newValidationError(file, document, line, err.Error()))
+	}
+
+	// javascript, lines of parser errors are relative to the script
+	if script := def.Modification.Javascript; script != "" {
+		if _, err := parser.ParseFile(nil, JavaScriptFilename, script, 0); err != nil {
+			start := line
+			if n := findYAMLNode(node, "modification", "javascript"); n != nil {
+				start = n.Line
+				// content of block scalars starts from the next line
+				if n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+					start++
+				}
+			}
+			var list *parser.ErrorList
+			if errors.As(err, &list) {
+				for _, item := range *list {
+					errs = append(errs, newValidationError(file, document, start+item.Position.Line-1, "javascript: "+item.Message))
+				}
+			} else {
+				errs = append(errs, newValidationError(file, document, start, "javascript: "+err.Error()))
+			}
+		}
+	}
+
+	// jsonpatch
+	ops := findYAMLNode(node, "modification", "jsonpatch")
+	for i, op := range def.Modification.JSONPatch {
+		if err := validateJSONPatchOperation(op); err != nil {
+			opLine := line
+			if ops != nil && i < len(ops.Content) {
+				opLine = ops.Content[i].Line
+			}
+			errs = append(errs, newValidationError(file, document, opLine, err.Error()))
+		}
+	}
+
+	return
+}
+
+// ValidateTaskDefinitionsFromFile validates task definitions in file strictly, unknown fields, scripts and jsonpatch operations are checked
+func ValidateTaskDefinitionsFromFile(file string) (errs []ValidationError, err error) {
+	defer rg.Guard(&err)
+
+	buf := rg.Must(os.ReadFile(file))
+
+	// decode documents twice, as nodes for locations, and strictly as TaskDefinition
+	nodes := yaml.NewDecoder(bytes.NewReader(buf))
+	strict := yaml.NewDecoder(bytes.NewReader(buf))
+	strict.KnownFields(true)
+
+	for document := 1; ; document++ {
+		var node yaml.Node
+
+		if err = nodes.Decode(&node); err != nil {
+			if !errors.Is(err, io.EOF) {
+				// syntax errors, following documents can not be decoded
+				errs = append(errs, newValidationError(file, document, 0, err.Error()))
+			}
+			err = nil
+			return
+		}
+
+		var def TaskDefinition
+
+		if err = strict.Decode(&def); err != nil {
+			var typeErr *yaml.TypeError
+			if errors.As(err, &typeErr) {
+				for _, message := range typeErr.Errors {
+					errs = append(errs, newValidationError(file, document, 0, message))
+				}
+			} else {
+				errs = append(errs, newValidationError(file, document, 0, err.Error()))
+			}
+			err = nil
+			continue
+		}
+
+		if len(node.Content) > 0 {
+			node = *node.Content[0]
+		}
+
+		errs = append(errs, validateTaskDefinitionNode(file, document, def, &node)...)
+	}
+}
+
+// ValidateTaskDefinitionsFromDir validates task definitions in dir strictly, see ValidateTaskDefinitionsFromFile
+func ValidateTaskDefinitionsFromDir(dir string) (errs []ValidationError, err error) {
+	defer rg.Guard(&err)
+
+	for _, entry := range rg.Must(os.ReadDir(dir)) {
+		if entry.IsDir() {
+			continue
+		}
+		if (!strings.HasSuffix(entry.Name(), ".yaml")) && (!strings.HasSuffix(entry.Name(), ".yml")) {
+			continue
+		}
+
+		errs = append(errs, rg.Must(ValidateTaskDefinitionsFromFile(filepath.Join(dir, entry.Name())))...)
+	}
+
+	return
+}
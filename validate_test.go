@@ -0,0 +1,42 @@
+package replikator
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTaskDefinitionsFromFile(t *testing.T) {
+	file := filepath.Join("testdata", "invalid", "tasks.yaml")
+
+	errs, err := ValidateTaskDefinitionsFromFile(file)
+	require.NoError(t, err)
+	require.Equal(t, []ValidationError{
+		{File: file, Document: 1, Line: 5, Message: "field targt not found in type replikator.TaskDefinition"},
+		{File: file, Document: 2, Line: 25, Message: "javascript: Unexpected identifier"},
+		{File: file, Document: 2, Line: 18, Message: `jsonpatch operation has unknown op: "delete"`},
+		{File: file, Document: 2, Line: 20, Message: `jsonpatch operation "add" has invalid 'path', must be a JSON pointer starting with '/': "spec/foo"`},
+		{File: file, Document: 3, Line: 27, Message: "source.name or source.selector is required"},
+	}, errs)
+	require.Equal(t, file+":5: document 1: field targt not found in type replikator.TaskDefinition", errs[0].Error())
+}
+
+func TestValidateTaskDefinitionsFromDir(t *testing.T) {
+	errs, err := ValidateTaskDefinitionsFromDir("testdata")
+	require.NoError(t, err)
+	require.Empty(t, errs)
+
+	errs, err = ValidateTaskDefinitionsFromDir(filepath.Join("testdata", "invalid"))
+	require.NoError(t, err)
+	require.Len(t, errs, 5)
+}
+
+func TestValidateJSONPatchOperation(t *testing.T) {
+	require.NoError(t, validateJSONPatchOperation(map[string]any{"op": "remove", "path": "/spec"}))
+	require.NoError(t, validateJSONPatchOperation(map[string]any{"op": "move", "from": "/a", "path": "/b"}))
+	require.Error(t, validateJSONPatchOperation("remove"))
+	require.Error(t, validateJSONPatchOperation(map[string]any{"op": "move", "path": "/b"}))
+	require.Error(t, validateJSONPatchOperation(map[string]any{"op": "replace", "path": "/b"}))
+	require.Error(t, validateJSONPatchOperation(map[string]any{"op": "remove"}))
+}